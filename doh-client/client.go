@@ -43,8 +43,8 @@ import (
 	"golang.org/x/net/idna"
 
 	"github.com/m13253/dns-over-https/v2/doh-client/config"
-	"github.com/m13253/dns-over-https/v2/doh-client/selector"
 	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+	"github.com/m13253/dns-over-https/v2/selector"
 )
 
 type Client struct {
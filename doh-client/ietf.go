@@ -37,8 +37,8 @@ import (
 
 	"github.com/miekg/dns"
 
-	"github.com/m13253/dns-over-https/v2/doh-client/selector"
 	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+	"github.com/m13253/dns-over-https/v2/selector"
 )
 
 func (c *Client) generateRequestIETF(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, isTCP bool, upstream *selector.Upstream) *DNSRequest {
@@ -0,0 +1,179 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authToken is a bearer token accepted by the server. Only the SHA-256 hash
+// of the token is stored.
+type authToken struct {
+	label string
+	// Maximum number of queries per quota period, 0 means unlimited
+	quota uint64
+}
+
+type tokenUsage struct {
+	periodStart time.Time
+	queries     uint64
+}
+
+// tokenStore holds the tokens from the token file and reloads them when the
+// file changes. Usage is kept by label so quotas survive reloads.
+type tokenStore struct {
+	path        string
+	file        *watchedFile
+	quotaPeriod time.Duration
+	mu          sync.Mutex
+	tokens      map[[sha256.Size]byte]*authToken
+	usage       map[string]*tokenUsage
+}
+
+type authTokenContextKey struct{}
+
+func newTokenStore(path string, quotaPeriod time.Duration) (*tokenStore, error) {
+	tokens, err := loadTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenStore{
+		path:        path,
+		file:        newWatchedFile(path),
+		quotaPeriod: quotaPeriod,
+		tokens:      tokens,
+		usage:       make(map[string]*tokenUsage),
+	}, nil
+}
+
+// loadTokenFile parses a token file. Each line has a label, the hex SHA-256
+// hash of the token and an optional query quota, separated by spaces.
+// Empty lines and lines starting with "#" are ignored.
+func loadTokenFile(path string) (map[[sha256.Size]byte]*authToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(data, path)
+}
+
+func parseTokens(data []byte, path string) (map[[sha256.Size]byte]*authToken, error) {
+	tokens := make(map[[sha256.Size]byte]*authToken)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"label hash [quota]\"", path, lineNo)
+		}
+		var hash [sha256.Size]byte
+		if n, err := hex.Decode(hash[:], []byte(fields[1])); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-256 hash %q", path, lineNo, fields[1])
+		}
+		token := &authToken{label: fields[0]}
+		if len(fields) == 3 {
+			quota, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quota %q", path, lineNo, fields[2])
+			}
+			token.quota = quota
+		}
+		tokens[hash] = token
+	}
+	return tokens, scanner.Err()
+}
+
+// lookup returns the token matching the plain-text token, or nil.
+func (ts *tokenStore) lookup(token string) *authToken {
+	if ts.file.changed() {
+		tokens, err := loadTokenFile(ts.path)
+		if err != nil {
+			log.Printf("Error reloading token file: %v\n", err)
+		} else {
+			ts.setTokens(tokens)
+		}
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.tokens[hash]
+}
+
+// setTokens replaces the tokens, and forgets the usage of labels that are
+// gone.
+func (ts *tokenStore) setTokens(tokens map[[sha256.Size]byte]*authToken) {
+	labels := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		labels[token.label] = true
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens = tokens
+	for label := range ts.usage {
+		if !labels[label] {
+			delete(ts.usage, label)
+		}
+	}
+}
+
+// consume counts one query against the token's quota and reports whether it
+// is still within the quota.
+func (ts *tokenStore) consume(token *authToken) bool {
+	if token.quota == 0 {
+		return true
+	}
+	now := time.Now()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	usage, ok := ts.usage[token.label]
+	if !ok || now.Sub(usage.periodStart) >= ts.quotaPeriod {
+		usage = &tokenUsage{periodStart: now}
+		ts.usage[token.label] = usage
+	}
+	if usage.queries >= token.quota {
+		return false
+	}
+	usage.queries++
+	return true
+}
+
+func authTokenFromContext(ctx context.Context) *authToken {
+	token, _ := ctx.Value(authTokenContextKey{}).(*authToken)
+	return token
+}
@@ -0,0 +1,144 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTokens(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`
+# label hash quota
+alice 2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90
+bob   81b637d8fcd2c6da6359e6963113a1170de795e4b725b84d1e0b4cfd9ec58ce9 2
+`)
+	tokens, err := parseTokens(data, "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(tokens))
+	}
+	alice := tokens[sha256.Sum256([]byte("alice"))]
+	if alice == nil || alice.label != "alice" || alice.quota != 0 {
+		t.Errorf("unexpected token for alice: %+v", alice)
+	}
+	bob := tokens[sha256.Sum256([]byte("bob"))]
+	if bob == nil || bob.label != "bob" || bob.quota != 2 {
+		t.Errorf("unexpected token for bob: %+v", bob)
+	}
+
+	for _, invalid := range []string{
+		"alice",
+		"alice nothex",
+		"alice 2bd806c9",
+		"bob 81b637d8fcd2c6da6359e6963113a1170de795e4b725b84d1e0b4cfd9ec58ce9 -1",
+		"bob 81b637d8fcd2c6da6359e6963113a1170de795e4b725b84d1e0b4cfd9ec58ce9 2 extra",
+	} {
+		if _, err := parseTokens([]byte(invalid), "tokens"); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestTokenQuota(t *testing.T) {
+	t.Parallel()
+
+	ts := &tokenStore{
+		quotaPeriod: time.Hour,
+		usage:       make(map[string]*tokenUsage),
+	}
+	limited := &authToken{label: "limited", quota: 2}
+	unlimited := &authToken{label: "unlimited"}
+	for i, expected := range []bool{true, true, false, false} {
+		if ok := ts.consume(limited); ok != expected {
+			t.Errorf("query %d: consume = %v, expected %v", i, ok, expected)
+		}
+		if !ts.consume(unlimited) {
+			t.Errorf("query %d: unlimited token was refused", i)
+		}
+	}
+
+	ts.usage["limited"].periodStart = time.Now().Add(-time.Hour)
+	if !ts.consume(limited) {
+		t.Error("quota was not reset after the quota period")
+	}
+}
+
+func TestAuthPreflight(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{conf: &config{}}
+	l := newTestListener()
+	l.tokens = &tokenStore{usage: make(map[string]*tokenUsage)}
+	for _, tt := range []struct {
+		method string
+		status int
+	}{
+		{http.MethodOptions, http.StatusOK},
+		{http.MethodGet, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(tt.method, "/dns-query", nil)
+		w := httptest.NewRecorder()
+		l.serveHTTP(http.HandlerFunc(s.handlerFunc), w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.method, w.Code, tt.status)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodOptions, "/dns-query", nil)
+	w := httptest.NewRecorder()
+	l.serveHTTP(http.HandlerFunc(s.handlerFunc), w, r)
+	if allowed := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "Authorization") {
+		t.Errorf("Authorization not allowed by CORS: %q", allowed)
+	}
+}
+
+func TestTokenReloadForgetsUsage(t *testing.T) {
+	t.Parallel()
+
+	ts := &tokenStore{
+		quotaPeriod: time.Hour,
+		usage:       make(map[string]*tokenUsage),
+	}
+	alice := &authToken{label: "alice", quota: 10}
+	bob := &authToken{label: "bob", quota: 10}
+	ts.consume(alice)
+	ts.consume(bob)
+
+	ts.setTokens(map[[sha256.Size]byte]*authToken{sha256.Sum256([]byte("alice")): alice})
+	if _, ok := ts.usage["alice"]; !ok {
+		t.Error("usage of a kept label forgotten")
+	}
+	if _, ok := ts.usage["bob"]; ok {
+		t.Error("usage of a removed label kept")
+	}
+}
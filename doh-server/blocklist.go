@@ -0,0 +1,113 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// blocklist is a set of domain names loaded from a file with one name per
+// line. A name also blocks all names under it. The file is reloaded when it
+// changes.
+type blocklist struct {
+	path    string
+	file    *watchedFile
+	mu      sync.RWMutex
+	domains map[string]struct{}
+}
+
+func newBlocklist(path string) (*blocklist, error) {
+	domains, err := loadBlocklistFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &blocklist{
+		path:    path,
+		file:    newWatchedFile(path),
+		domains: domains,
+	}, nil
+}
+
+// loadBlocklistFile reads domain names, ignoring empty lines and comments
+// starting with "#". Hosts file style lines such as "0.0.0.0 example.com" are
+// accepted as well.
+func loadBlocklistFile(path string) (map[string]struct{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// A hosts file line has an address followed by one or more names.
+		names := fields
+		if net.ParseIP(fields[0]) != nil {
+			names = fields[1:]
+		}
+		for _, name := range names {
+			domains[dns.CanonicalName(name)] = struct{}{}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// contains reports whether name or any of its parent domains is blocked.
+func (bl *blocklist) contains(name string) bool {
+	if bl.file.changed() {
+		domains, err := loadBlocklistFile(bl.path)
+		if err != nil {
+			log.Printf("Error reloading blocklist: %v\n", err)
+		} else {
+			bl.mu.Lock()
+			bl.domains = domains
+			bl.mu.Unlock()
+		}
+	}
+
+	name = dns.CanonicalName(name)
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := bl.domains[name[off:]]; ok {
+			return true
+		}
+	}
+	return false
+}
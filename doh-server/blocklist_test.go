@@ -0,0 +1,70 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	data := []byte(`# Ads
+ads.example.com
+Tracker.Example.NET.  # trailing comment
+
+0.0.0.0 malware.example.org
+127.0.0.1 phishing.example phishing2.example
+::1 v6.example
+`)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	bl, err := newBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"ads.example.com.":     true,
+		"www.ads.example.com.": true,
+		"example.com.":         false,
+		"notads.example.com.":  false,
+		"tracker.example.net.": true,
+		"malware.example.org":  true,
+		"phishing.example.":    true,
+		"phishing2.example.":   true,
+		"v6.example.":          true,
+		"0.0.0.0.":             false,
+		"127.0.0.1.":           false,
+		"comment.":             false,
+		"trailing.comment.":    false,
+	} {
+		if got := bl.contains(name); got != want {
+			t.Errorf("contains(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// responseCache keeps upstream responses for their TTL, least recently used
+// entries are evicted first. Entries are keyed like coalesced queries, so
+// views and upstream groups never share answers.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[coalesceKey]*list.Element
+	lru     *list.List
+
+	prefetchPercent uint
+	prefetchMinHits uint
+	// Bounds the prefetch queries in flight, nil if prefetching is off
+	prefetchSem chan struct{}
+
+	// Serve-stale (RFC 8767): expired entries are kept for staleWindow
+	// seconds and served with staleTTL when upstream fails or takes longer
+	// than staleTimeout.
+	staleWindow  uint32
+	staleTTL     uint32
+	staleTimeout time.Duration
+}
+
+type cacheEntry struct {
+	key        coalesceKey
+	response   *dns.Msg
+	upstream   string
+	isTailored bool
+	stored     time.Time
+	ttl        uint32
+	// Requests since the entry was stored
+	hits        uint
+	prefetching bool
+}
+
+func newResponseCache(conf *config) *responseCache {
+	if conf.CacheSize == 0 {
+		return nil
+	}
+	c := &responseCache{
+		size:            conf.CacheSize,
+		entries:         make(map[coalesceKey]*list.Element),
+		lru:             list.New(),
+		prefetchPercent: conf.PrefetchPercent,
+		prefetchMinHits: conf.PrefetchMinHits,
+	}
+	if conf.Prefetch {
+		c.prefetchSem = make(chan struct{}, conf.PrefetchMaxInflight)
+	}
+	if conf.ServeStale {
+		c.staleWindow = conf.StaleAnswerWindow
+		c.staleTTL = conf.StaleAnswerTTL
+		c.staleTimeout = time.Duration(conf.StaleAnswerClientTimeout) * time.Millisecond
+	}
+	return c
+}
+
+// get fills req from the cache and reports whether it did, and whether the
+// entry is due for a prefetch. The response is a copy with TTLs counted down.
+func (c *responseCache) get(key coalesceKey, req *DNSRequest) (ok, prefetch bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		metricCacheMisses.Add(1)
+		return false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	age := uint32(time.Since(entry.stored) / time.Second)
+	if age >= entry.ttl {
+		// Keep expired entries around in case they are needed stale.
+		if age-entry.ttl >= c.staleWindow {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+		metricCacheMisses.Add(1)
+		return false, false
+	}
+	c.lru.MoveToFront(elem)
+	metricCacheHits.Add(1)
+	entry.hits++
+
+	req.response = entry.response.Copy()
+	req.response.Question = append([]dns.Question(nil), req.request.Question...)
+	for _, section := range [][]dns.RR{req.response.Answer, req.response.Ns, req.response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl -= age
+			}
+		}
+	}
+	req.currentUpstream = entry.upstream
+	req.isTailored = entry.isTailored
+
+	// Refresh popular entries in the last prefetchPercent of their TTL.
+	left := uint64(entry.ttl - age)
+	if c.prefetchSem != nil && !entry.prefetching && entry.hits >= c.prefetchMinHits && left*100 <= uint64(entry.ttl)*uint64(c.prefetchPercent) {
+		entry.prefetching = true
+		prefetch = true
+	}
+	return true, prefetch
+}
+
+// set stores a copy of the response in req and reports whether it could be
+// cached.
+func (c *responseCache) set(key coalesceKey, req *DNSRequest) bool {
+	if c == nil {
+		return false
+	}
+	ttl, ok := cacheTTL(req.response)
+	if !ok {
+		return false
+	}
+	entry := &cacheEntry{
+		key:        key,
+		response:   req.response.Copy(),
+		upstream:   req.currentUpstream,
+		isTailored: req.isTailored,
+		stored:     time.Now(),
+		ttl:        ttl,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[key]; elem != nil {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return true
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return true
+}
+
+// getStale fills req with an expired entry within the stale window and
+// reports whether it did. The records get the stale TTL, and an Extended DNS
+// Error tells the client the answer is stale.
+func (c *responseCache) getStale(key coalesceKey, req *DNSRequest) bool {
+	if c == nil || c.staleWindow == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	age := uint32(time.Since(entry.stored) / time.Second)
+	if age >= entry.ttl+c.staleWindow {
+		return false
+	}
+	metricStaleAnswers.Add(1)
+
+	req.response = entry.response.Copy()
+	req.response.Question = append([]dns.Question(nil), req.request.Question...)
+	for _, section := range [][]dns.RR{req.response.Answer, req.response.Ns, req.response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = c.staleTTL
+			}
+		}
+	}
+	opt := req.response.IsEdns0()
+	if opt == nil && req.clientEDNS {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		req.response.Extra = append(req.response.Extra, opt)
+	}
+	if opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	req.currentUpstream = entry.upstream
+	req.isTailored = entry.isTailored
+	return true
+}
+
+// staleClientTimeout returns how long a request waits for upstream before it
+// is answered stale, or 0.
+func (c *responseCache) staleClientTimeout() time.Duration {
+	if c == nil || c.staleWindow == 0 {
+		return 0
+	}
+	return c.staleTimeout
+}
+
+// prefetchFailed lets the next request try to prefetch the entry again.
+func (c *responseCache) prefetchFailed(key coalesceKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[key]; elem != nil {
+		elem.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// cacheTTL returns how long msg can be cached: the lowest TTL of its records,
+// or for negative answers the SOA minimum (RFC 2308). Only NOERROR and
+// NXDOMAIN answers are cached.
+func cacheTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	lower := func(t uint32) {
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			switch rr := rr.(type) {
+			case *dns.OPT:
+				continue
+			case *dns.SOA:
+				if len(msg.Answer) == 0 {
+					lower(rr.Minttl)
+				}
+			}
+			lower(rr.Header().Ttl)
+		}
+	}
+	if len(msg.Answer) == 0 && !hasSOA(msg.Ns) {
+		// A negative answer without SOA must not be cached.
+		return 0, false
+	}
+	return ttl, found && ttl != 0
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetch refreshes the cache entry of req from upstream in the background.
+// The query is coalesced with client queries for the same key and takes a
+// slot from the query limiter, but does not count toward the client's rate
+// limit. Concurrent prefetches are bounded on their own.
+func (s *Server) prefetch(ctx context.Context, key coalesceKey, req *DNSRequest) {
+	c := s.cache
+	select {
+	case c.prefetchSem <- struct{}{}:
+	default:
+		c.prefetchFailed(key)
+		return
+	}
+	co := s.coalescer
+	co.mu.Lock()
+	if co.pending[key] != nil {
+		// A query for the same key is in flight already, its answer
+		// refreshes the entry.
+		co.mu.Unlock()
+		<-c.prefetchSem
+		c.prefetchFailed(key)
+		return
+	}
+	q := &coalescedQuery{done: make(chan struct{})}
+	co.pending[key] = q
+	co.mu.Unlock()
+
+	metricCachePrefetches.Add(1)
+	prefetchReq := &DNSRequest{
+		request:   req.request.Copy(),
+		profile:   req.profile,
+		upstreams: req.upstreams,
+		clientIP:  req.clientIP,
+		view:      req.view,
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() { <-c.prefetchSem }()
+		if !s.runCoalescedQuery(ctx, key, q, prefetchReq) {
+			if q.err != nil {
+				log.Printf("Prefetch from upstream %s failed: %s\n", prefetchReq.currentUpstream, q.err.Error())
+			}
+			c.prefetchFailed(key)
+		}
+	}()
+}
@@ -0,0 +1,342 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheTTL(t *testing.T) {
+	t.Parallel()
+
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{rr("www.example. 300 IN CNAME web.example."), rr("web.example. 60 IN A 192.0.2.1")}
+	if ttl, ok := cacheTTL(msg); !ok || ttl != 60 {
+		t.Errorf("answer: got %d %v, want 60", ttl, ok)
+	}
+
+	msg = new(dns.Msg)
+	msg.Rcode = dns.RcodeNameError
+	msg.Ns = []dns.RR{rr("example. 3600 IN SOA ns.example. h.example. 1 2 3 4 30")}
+	if ttl, ok := cacheTTL(msg); !ok || ttl != 30 {
+		t.Errorf("NXDOMAIN: got %d %v, want 30", ttl, ok)
+	}
+
+	msg.Ns = nil
+	if _, ok := cacheTTL(msg); ok {
+		t.Error("negative answer without SOA cached")
+	}
+
+	msg = new(dns.Msg)
+	msg.Rcode = dns.RcodeServerFailure
+	if _, ok := cacheTTL(msg); ok {
+		t.Error("SERVFAIL cached")
+	}
+}
+
+func TestResponseCachePrefetch(t *testing.T) {
+	t.Parallel()
+
+	c := newResponseCache(&config{CacheSize: 1, Prefetch: true, PrefetchPercent: 50, PrefetchMinHits: 2, PrefetchMaxInflight: 1})
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	a, _ := dns.NewRR("www.example. 10 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, a)
+	key := coalesceKey{name: "www.example.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	c.set(key, &DNSRequest{request: query, response: resp})
+
+	req := &DNSRequest{request: query}
+	if ok, prefetch := c.get(key, req); !ok || prefetch {
+		t.Fatalf("first hit: ok = %v, prefetch = %v", ok, prefetch)
+	}
+	// Age the entry into the last half of its TTL.
+	c.entries[key].Value.(*cacheEntry).stored = time.Now().Add(-6 * time.Second)
+	if ok, prefetch := c.get(key, req); !ok || !prefetch {
+		t.Fatalf("second hit: ok = %v, prefetch = %v", ok, prefetch)
+	}
+	if ttl := req.response.Answer[0].Header().Ttl; ttl != 4 {
+		t.Errorf("TTL not counted down: %d", ttl)
+	}
+	if _, prefetch := c.get(key, req); prefetch {
+		t.Error("prefetch started twice")
+	}
+
+	other := coalesceKey{name: "other.example.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	c.set(other, &DNSRequest{request: query, response: resp})
+	if ok, _ := c.get(key, req); ok {
+		t.Error("least recently used entry not evicted")
+	}
+}
+
+func TestResponseCacheStale(t *testing.T) {
+	t.Parallel()
+
+	c := newResponseCache(&config{CacheSize: 1, ServeStale: true, StaleAnswerWindow: 60, StaleAnswerTTL: 30})
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	a, _ := dns.NewRR("www.example. 10 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, a)
+	key := coalesceKey{name: "www.example.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	c.set(key, &DNSRequest{request: query, response: resp})
+	entry := c.entries[key].Value.(*cacheEntry)
+
+	entry.stored = time.Now().Add(-20 * time.Second)
+	req := &DNSRequest{request: query, clientEDNS: true}
+	if ok, _ := c.get(key, req); ok {
+		t.Fatal("expired entry served fresh")
+	}
+	if !c.getStale(key, req) {
+		t.Fatal("no stale answer within the window")
+	}
+	if ttl := req.response.Answer[0].Header().Ttl; ttl != 30 {
+		t.Errorf("stale TTL = %d, want 30", ttl)
+	}
+	opt := req.response.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("missing Stale Answer EDE: %v", opt)
+	}
+
+	entry.stored = time.Now().Add(-80 * time.Second)
+	if c.getStale(key, req) {
+		t.Error("stale answer served after the window")
+	}
+}
+
+func TestResponseCacheUpstreamECS(t *testing.T) {
+	t.Parallel()
+
+	// The upstream answers with the subnet it was sent.
+	var queries atomic.Int32
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		for _, option := range r.IsEdns0().Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   subnet.Address,
+				})
+			}
+		}
+		w.WriteMsg(resp)
+	})
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+cache_size = 10
+ecs_allow_non_global_ip = true
+
+[upstream_options.%q]
+ecs_ipv4_prefix = 32
+`, upstream, upstream))
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clientIP := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+		r.Header.Set("X-Real-IP", clientIP)
+		w := httptest.NewRecorder()
+		s.handlerFunc(w, r)
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP(clientIP)) {
+			t.Errorf("client %s got %v", clientIP, resp.Answer)
+		}
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("%d upstream queries, want 2", got)
+	}
+}
+
+func TestServeStaleOnServfail(t *testing.T) {
+	t.Parallel()
+
+	var queries atomic.Int32
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		if queries.Add(1) == 1 {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		} else {
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(resp)
+	})
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+cache_size = 10
+serve_stale = true
+`, upstream))
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	query.SetEdns0(dns.DefaultMsgSize, false)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func() *dns.Msg {
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+		w := httptest.NewRecorder()
+		s.handlerFunc(w, r)
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resolve()
+	for _, elem := range s.cache.entries {
+		elem.Value.(*cacheEntry).stored = time.Now().Add(-time.Minute)
+	}
+	resp := resolve()
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("no stale answer after SERVFAIL:\n%v", resp)
+	}
+	opt := resp.IsEdns0()
+	if opt == nil || len(opt.Option) == 0 || opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("missing Stale Answer EDE: %v", opt)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("%d upstream queries, want 2", got)
+	}
+}
+
+func TestPrefetchCoalesced(t *testing.T) {
+	t.Parallel()
+
+	var queries atomic.Int32
+	unblock := make(chan struct{})
+	release := sync.OnceFunc(func() { close(unblock) })
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if queries.Add(1) > 1 {
+			<-unblock
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		w.WriteMsg(resp)
+	})
+	// Before the upstream shuts down, which waits for its handlers
+	t.Cleanup(release)
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+timeout = 10
+cache_size = 10
+prefetch = true
+prefetch_percent = 50
+prefetch_min_hits = 1
+max_inflight_queries = 1
+query_queue_size = 0
+`, upstream))
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func() *dns.Msg {
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+		w := httptest.NewRecorder()
+		s.handlerFunc(w, r)
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.Body.Bytes()); err != nil {
+			t.Error(err)
+		}
+		return resp
+	}
+	age := func(d time.Duration) {
+		s.cache.mu.Lock()
+		defer s.cache.mu.Unlock()
+		for _, elem := range s.cache.entries {
+			elem.Value.(*cacheEntry).stored = time.Now().Add(-d)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); {
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	resolve()
+	age(6 * time.Second)
+	resolve()
+	waitFor("no prefetch sent", func() bool { return queries.Load() == 2 })
+	if n := len(s.limiter.slots); n != 1 {
+		t.Errorf("prefetch holds %d query limiter slots, want 1", n)
+	}
+
+	// With the only slot taken and no queue, the expired entry can only be
+	// resolved by waiting for the prefetch.
+	age(time.Minute)
+	coalesced := metricCoalescedQueries.Value()
+	done := make(chan *dns.Msg, 1)
+	go func() { done <- resolve() }()
+	waitFor("query not coalesced with the prefetch", func() bool { return metricCoalescedQueries.Value() > coalesced })
+	release()
+	if resp := <-done; resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("unexpected answer while prefetching:\n%v", resp)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("%d upstream queries, want 2", got)
+	}
+}
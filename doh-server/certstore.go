@@ -0,0 +1,190 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificate is a key pair, optionally with a stapled OCSP response, that is
+// reloaded when its files change on disk.
+type certificate struct {
+	conf       *certificateConfig
+	certFile   *watchedFile
+	keyFile    *watchedFile
+	ocspFile   *watchedFile
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	ocspExpiry time.Time
+}
+
+func loadCertificate(conf *certificateConfig) (*certificate, error) {
+	c := &certificate{
+		conf:     conf,
+		certFile: newWatchedFile(conf.Cert),
+		keyFile:  newWatchedFile(conf.Key),
+	}
+	if conf.OCSPStaple != "" {
+		c.ocspFile = newWatchedFile(conf.OCSPStaple)
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certificate) load() error {
+	cert, err := tls.LoadX509KeyPair(c.conf.Cert, c.conf.Key)
+	if err != nil {
+		return err
+	}
+	var ocspExpiry time.Time
+	if c.conf.OCSPStaple != "" {
+		staple, nextUpdate, err := loadOCSPStaple(c.conf.OCSPStaple, &cert)
+		if err != nil {
+			// Serving without a staple is better than not serving at all.
+			log.Printf("Not stapling OCSP response %s: %v\n", c.conf.OCSPStaple, err)
+		} else {
+			cert.OCSPStaple = staple
+			ocspExpiry = nextUpdate
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.ocspExpiry = ocspExpiry
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certificate) get() *tls.Certificate {
+	// Check every file, a renewal usually replaces them one after another.
+	certChanged := c.certFile.changed()
+	keyChanged := c.keyFile.changed()
+	ocspChanged := c.ocspFile.changed()
+
+	c.mu.RLock()
+	ocspExpired := !c.ocspExpiry.IsZero() && time.Now().After(c.ocspExpiry)
+	c.mu.RUnlock()
+
+	if certChanged || keyChanged || ocspChanged || ocspExpired {
+		if err := c.load(); err != nil {
+			log.Printf("Error reloading server certificate key pair %s: %v\n", c.conf.Cert, err)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+// names returns the server names this certificate is selected for.
+func (c *certificate) names() []string {
+	if len(c.conf.ServerNames) != 0 {
+		return c.conf.ServerNames
+	}
+	leaf := c.get().Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(c.get().Certificate[0])
+		if err != nil {
+			return nil
+		}
+	}
+	if len(leaf.DNSNames) != 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+	return nil
+}
+
+// certStore selects a certificate by the server name sent in TLS SNI.
+type certStore struct {
+	byName      map[string]*certificate
+	defaultCert *certificate
+}
+
+func newCertStore(confs []certificateConfig) (*certStore, error) {
+	cs := &certStore{
+		byName: make(map[string]*certificate),
+	}
+	for i := range confs {
+		c, err := loadCertificate(&confs[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range c.names() {
+			name = normalizeServerName(name)
+			if _, ok := cs.byName[name]; !ok {
+				cs.byName[name] = c
+			}
+		}
+		if confs[i].Default || cs.defaultCert == nil {
+			cs.defaultCert = c
+		}
+	}
+	return cs, nil
+}
+
+// lookup returns the certificate matching serverName exactly or by a
+// wildcard covering its left-most label, or nil if there is none.
+func (cs *certStore) lookup(serverName string) *certificate {
+	if cs == nil || serverName == "" {
+		return nil
+	}
+	name := normalizeServerName(serverName)
+	if c, ok := cs.byName[name]; ok {
+		return c
+	}
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if c, ok := cs.byName["*"+name[dot:]]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// hasPath reports whether any certificate serves the given path.
+func (cs *certStore) hasPath(path string) bool {
+	if cs == nil {
+		return false
+	}
+	for _, c := range cs.byName {
+		if c.conf.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeServerName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
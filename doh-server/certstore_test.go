@@ -0,0 +1,57 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCertStoreLookup(t *testing.T) {
+	t.Parallel()
+
+	exact := &certificate{conf: &certificateConfig{Cert: "exact"}}
+	wildcard := &certificate{conf: &certificateConfig{Cert: "wildcard"}}
+	cs := &certStore{
+		byName: map[string]*certificate{
+			"dns.example.com": exact,
+			"*.example.net":   wildcard,
+		},
+		defaultCert: exact,
+	}
+
+	for serverName, expected := range map[string]*certificate{
+		"dns.example.com":     exact,
+		"DNS.Example.COM.":    exact,
+		"doh.example.net":     wildcard,
+		"example.net":         nil,
+		"a.doh.example.net":   nil,
+		"other.example.com":   nil,
+		"":                    nil,
+		"dns.example.com.org": nil,
+	} {
+		if c := cs.lookup(serverName); c != expected {
+			t.Errorf("lookup(%q) = %v, expected %v", serverName, c, expected)
+		}
+	}
+}
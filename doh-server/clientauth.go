@@ -0,0 +1,216 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// clientIdentity is the subject of a verified TLS client certificate.
+type clientIdentity struct {
+	commonName string
+	// Subject alternative names: DNS names, email addresses and URIs
+	altNames []string
+}
+
+// clientIdentityFromRequest returns the identity of the verified client
+// certificate, or nil if the client did not present one.
+func clientIdentityFromRequest(r *http.Request) *clientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	id := &clientIdentity{
+		commonName: cert.Subject.CommonName,
+	}
+	id.altNames = append(id.altNames, cert.DNSNames...)
+	id.altNames = append(id.altNames, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		id.altNames = append(id.altNames, uri.String())
+	}
+	return id
+}
+
+func (id *clientIdentity) String() string {
+	if id.commonName != "" {
+		return id.commonName
+	}
+	if len(id.altNames) != 0 {
+		return id.altNames[0]
+	}
+	return "-"
+}
+
+// matches reports whether the common name or any alternative name equals
+// pattern. A pattern starting with "*." matches any name under that domain.
+func (id *clientIdentity) matches(pattern string) bool {
+	match := func(name string) bool {
+		if name == "" {
+			return false
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") {
+			return len(name) > len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix)
+		}
+		return strings.EqualFold(name, pattern)
+	}
+	if match(id.commonName) {
+		return true
+	}
+	for _, name := range id.altNames {
+		if match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findClientIdentityConfig returns the first [[client_identity]] matching the
+// identity, or nil.
+func (s *Server) findClientIdentityConfig(id *clientIdentity) *clientIdentityConfig {
+	if id == nil {
+		return nil
+	}
+	for i := range s.conf.ClientIdentities {
+		for _, pattern := range s.conf.ClientIdentities[i].Names {
+			if id.matches(pattern) {
+				return &s.conf.ClientIdentities[i]
+			}
+		}
+	}
+	return nil
+}
+
+// crlStore holds certificate revocation lists loaded from a PEM or DER file,
+// and reloads them when the file changes.
+type crlStore struct {
+	path string
+	file *watchedFile
+	mu   sync.RWMutex
+	crls []*revocationList
+}
+
+type revocationList struct {
+	list    *x509.RevocationList
+	revoked map[string]struct{}
+}
+
+func newCRLStore(path string) (*crlStore, error) {
+	crls, err := loadCRLFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &crlStore{
+		path: path,
+		file: newWatchedFile(path),
+		crls: crls,
+	}, nil
+}
+
+func loadCRLFile(path string) ([]*revocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ders [][]byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = append(ders, data)
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("no CRL found in %s", path)
+	}
+
+	crls := make([]*revocationList, 0, len(ders))
+	for _, der := range ders {
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CRL in %s: %w", path, err)
+		}
+		crl := &revocationList{
+			list:    list,
+			revoked: make(map[string]struct{}, len(list.RevokedCertificateEntries)),
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			crl.revoked[entry.SerialNumber.String()] = struct{}{}
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// verifyConnection is used as tls.Config.VerifyConnection to reject client
+// certificates revoked by a CRL signed by their issuer.
+func (cs *crlStore) verifyConnection(state tls.ConnectionState) error {
+	if cs.file.changed() {
+		crls, err := loadCRLFile(cs.path)
+		if err != nil {
+			log.Printf("Error reloading CRL file: %v\n", err)
+		} else {
+			cs.mu.Lock()
+			cs.crls = crls
+			cs.mu.Unlock()
+		}
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, chain := range state.VerifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, crl := range cs.crls {
+				if !bytes.Equal(crl.list.RawIssuer, issuer.RawSubject) {
+					continue
+				}
+				if crl.list.CheckSignatureFrom(issuer) != nil {
+					continue
+				}
+				if _, revoked := crl.revoked[cert.SerialNumber.String()]; revoked {
+					return errors.New("client certificate has been revoked")
+				}
+			}
+		}
+	}
+	return nil
+}
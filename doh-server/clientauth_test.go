@@ -0,0 +1,53 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestClientIdentityMatches(t *testing.T) {
+	t.Parallel()
+
+	id := &clientIdentity{
+		commonName: "Alice",
+		altNames:   []string{"laptop.corp.example.com", "alice@example.com", "spiffe://example.com/alice"},
+	}
+	for pattern, expected := range map[string]bool{
+		"alice":                      true,
+		"laptop.corp.example.com":    true,
+		"*.example.com":              true,
+		"*.corp.example.com":         true,
+		"*.laptop.corp.example.com":  false,
+		"ALICE@example.com":          true,
+		"spiffe://example.com/alice": true,
+		"bob":                        false,
+		"*":                          false,
+		"":                           false,
+	} {
+		if matched := id.matches(pattern); matched != expected {
+			t.Errorf("matches(%q) = %v, expected %v", pattern, matched, expected)
+		}
+	}
+}
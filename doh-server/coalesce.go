@@ -0,0 +1,206 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/m13253/dns-over-https/v2/selector"
+)
+
+// coalesceKey identifies queries that get the same answer from upstream.
+type coalesceKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+	// EDNS Client Subnets as sent to each upstream that may be picked
+	ecs       string
+	view      *view
+	upstreams selector.Selector
+}
+
+// coalescedQuery is an upstream query that other requests wait for.
+type coalescedQuery struct {
+	done       chan struct{}
+	response   *dns.Msg
+	upstream   string
+	isTailored bool
+	err        error
+}
+
+// coalescer keeps one upstream query in flight for identical questions.
+type coalescer struct {
+	mu      sync.Mutex
+	pending map[coalesceKey]*coalescedQuery
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		pending: make(map[coalesceKey]*coalescedQuery),
+	}
+}
+
+// doDNSQuery resolves req from the cache or with upstream. If an identical
+// question is already being resolved, it waits for that answer instead of
+// sending another query. When upstream fails or is slow, a stale answer from
+// the cache may be served instead.
+func (s *Server) doDNSQuery(ctx context.Context, req *DNSRequest) error {
+	if len(req.request.Question) == 0 {
+		return s.limitedQueryUpstream(ctx, req)
+	}
+	key := s.coalesceKey(ctx, req)
+	if ok, prefetch := s.cache.get(key, req); ok {
+		if prefetch {
+			s.prefetch(ctx, key, req)
+		}
+		return nil
+	}
+
+	c := s.coalescer
+	c.mu.Lock()
+	q := c.pending[key]
+	if q != nil {
+		c.mu.Unlock()
+		metricCoalescedQueries.Add(1)
+	} else {
+		q = &coalescedQuery{done: make(chan struct{})}
+		c.pending[key] = q
+		c.mu.Unlock()
+		// The query runs on its own copy of the request. Other requests
+		// depend on the answer, so it must outlive this request, which
+		// may also be answered stale before the query completes.
+		queryReq := *req
+		go s.runCoalescedQuery(context.WithoutCancel(ctx), key, q, &queryReq)
+	}
+
+	var staleTimer <-chan time.Time
+	if timeout := s.cache.staleClientTimeout(); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		staleTimer = timer.C
+	}
+	for {
+		select {
+		case <-q.done:
+			// Upstream answering SERVFAIL after every try is as much an
+			// outage as not answering.
+			if q.err != nil || q.response.Rcode == dns.RcodeServerFailure {
+				if s.cache.getStale(key, req) {
+					return nil
+				}
+			}
+			if q.err != nil {
+				return q.err
+			}
+			// Every request gets its own copy to rewrite, with its own
+			// question; the transaction ID is set when the response is
+			// written.
+			req.response = q.response.Copy()
+			req.response.Question = append([]dns.Question(nil), req.request.Question...)
+			req.currentUpstream = q.upstream
+			req.isTailored = q.isTailored
+			return nil
+		case <-staleTimer:
+			if s.cache.getStale(key, req) {
+				return nil
+			}
+			staleTimer = nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runCoalescedQuery resolves q with upstream, and reports whether the answer
+// was cached.
+func (s *Server) runCoalescedQuery(ctx context.Context, key coalesceKey, q *coalescedQuery, req *DNSRequest) (cached bool) {
+	q.err = s.limitedQueryUpstream(ctx, req)
+	if q.err == nil {
+		q.response = req.response
+		q.upstream = req.currentUpstream
+		q.isTailored = req.isTailored
+		cached = s.cache.set(key, req)
+	}
+
+	c := s.coalescer
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+	close(q.done)
+	return cached
+}
+
+func (s *Server) coalesceKey(ctx context.Context, req *DNSRequest) coalesceKey {
+	question := &req.request.Question[0]
+	key := coalesceKey{
+		name:      strings.ToLower(question.Name),
+		qtype:     question.Qtype,
+		qclass:    question.Qclass,
+		cd:        req.request.CheckingDisabled,
+		view:      req.view,
+		upstreams: req.upstreams,
+	}
+	if opt := req.request.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	// The upstream is not known before it is picked, so only clients that
+	// would send the same ECS option to any of them share an answer.
+	upstreams := req.upstreams
+	if upstreams == nil {
+		upstreams = s.selectors[""]
+	}
+	seen := make(map[ecsPolicy]struct{})
+	var ecs []string
+	for _, upstream := range append([]string{""}, s.reachable[upstreams]...) {
+		policy := s.ecsPolicyFor(ctx, upstream)
+		if _, ok := seen[policy]; ok {
+			continue
+		}
+		seen[policy] = struct{}{}
+		query, _ := policy.apply(req.request, req.clientIP)
+		ecs = append(ecs, querySubnet(query))
+	}
+	key.ecs = strings.Join(ecs, " ")
+	return key
+}
+
+// querySubnet returns the ECS option of msg as text, or "" if it has none.
+func querySubnet(msg *dns.Msg) string {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+			}
+		}
+	}
+	return ""
+}
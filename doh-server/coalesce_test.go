@@ -0,0 +1,176 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestUpstream serves handler on a UDP port of the loopback interface and
+// returns its address as written in upstream lists.
+func startTestUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return "udp:" + pc.LocalAddr().String()
+}
+
+// newTestServer builds a Server from a configuration file with the given
+// contents.
+func newTestServer(t *testing.T, conf string) *Server {
+	path := filepath.Join(t.TempDir(), "doh-server.conf")
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCoalesceKey(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{conf: &config{ECSMode: "add", ECSIPv4Prefix: 24, ECSIPv6Prefix: 56}}
+	request := func(name string, do bool, clientIP string) *DNSRequest {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, do)
+		return &DNSRequest{request: msg, clientIP: net.ParseIP(clientIP)}
+	}
+	ctx := context.Background()
+
+	key := s.coalesceKey(ctx, request("www.example.com.", false, "192.0.2.1"))
+	if other := s.coalesceKey(ctx, request("WWW.Example.com.", false, "192.0.2.200")); other != key {
+		t.Errorf("same question from the same /24 not coalesced: %+v %+v", key, other)
+	}
+	if other := s.coalesceKey(ctx, request("www.example.com.", true, "192.0.2.1")); other == key {
+		t.Error("DO bit ignored")
+	}
+	if other := s.coalesceKey(ctx, request("www.example.com.", false, "198.51.100.1")); other == key {
+		t.Error("client subnet ignored")
+	}
+}
+
+func TestCoalesceKeyUpstreamECS(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t, `
+upstream = ["udp:192.0.2.53:53"]
+ecs_allow_non_global_ip = true
+
+[upstream_group]
+precise = ["udp:192.0.2.53:53", "udp:198.51.100.53:53"]
+
+[upstream_options."udp:198.51.100.53:53"]
+ecs_mode = "override"
+ecs_ipv4_prefix = 32
+`)
+	request := func(group, clientIP string) *DNSRequest {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		return &DNSRequest{request: msg, clientIP: net.ParseIP(clientIP), upstreams: s.selectors[group]}
+	}
+	ctx := context.Background()
+
+	if s.coalesceKey(ctx, request("", "192.0.2.1")) != s.coalesceKey(ctx, request("", "192.0.2.2")) {
+		t.Error("same /24 not coalesced where every upstream sends a /24")
+	}
+	if s.coalesceKey(ctx, request("precise", "192.0.2.1")) == s.coalesceKey(ctx, request("precise", "192.0.2.2")) {
+		t.Error("same /24 coalesced where an upstream may get each address")
+	}
+}
+
+func TestCoalescedQueries(t *testing.T) {
+	t.Parallel()
+
+	var queries atomic.Int32
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		// Long enough for every request to join the query in flight
+		time.Sleep(200 * time.Millisecond)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		w.WriteMsg(resp)
+	})
+	s := newTestServer(t, fmt.Sprintf("upstream = [%q]\n", upstream))
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("www.example.com.", dns.TypeA)
+			msg.Id = id
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+			w := httptest.NewRecorder()
+			s.handlerFunc(w, r)
+			resp := new(dns.Msg)
+			if err := resp.Unpack(w.Body.Bytes()); err != nil {
+				t.Errorf("query %d: %v", id, err)
+				return
+			}
+			if resp.Id != id || len(resp.Answer) != 1 {
+				t.Errorf("query %d: got ID %d with %d answers", id, resp.Id, len(resp.Answer))
+			}
+		}(uint16(1000 + i))
+	}
+	wg.Wait()
+	if got := queries.Load(); got != 1 {
+		t.Errorf("%d upstream queries, want 1", got)
+	}
+}
@@ -24,10 +24,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
 	"regexp"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
 )
 
 type config struct {
@@ -39,13 +43,190 @@ type config struct {
 	DebugHTTPHeaders    []string `toml:"debug_http_headers"`
 	Listen              []string `toml:"listen"`
 	Upstream            []string `toml:"upstream"`
+	UpstreamSelector    string   `toml:"upstream_selector"`
 	Timeout             uint     `toml:"timeout"`
 	Tries               uint     `toml:"tries"`
 	Verbose             bool     `toml:"verbose"`
 	LogGuessedIP        bool     `toml:"log_guessed_client_ip"`
+	TrustedProxies      []string `toml:"trusted_proxies"`
 	ECSAllowNonGlobalIP bool     `toml:"ecs_allow_non_global_ip"`
 	ECSUsePreciseIP     bool     `toml:"ecs_use_precise_ip"`
+	ECSMode             string   `toml:"ecs_mode"`
+	ECSIPv4Prefix       uint     `toml:"ecs_ipv4_prefix"`
+	ECSIPv6Prefix       uint     `toml:"ecs_ipv6_prefix"`
 	TLSClientAuth       bool     `toml:"tls_client_auth"`
+	TLSClientAuthCRL    string   `toml:"tls_client_auth_crl"`
+
+	RetryRcodes           []string `toml:"retry_rcodes"`
+	FallbackUpstreamGroup string   `toml:"fallback_upstream_group"`
+	SplitTimeout          bool     `toml:"split_timeout"`
+
+	MirrorUpstream         string  `toml:"mirror_upstream"`
+	MirrorSampleRate       float64 `toml:"mirror_sample_rate"`
+	MirrorLatencyThreshold uint    `toml:"mirror_latency_threshold"`
+	MirrorMaxInflight      uint    `toml:"mirror_max_inflight"`
+
+	PadTLSResponses bool `toml:"pad_tls_responses"`
+	DNS0x20         bool `toml:"dns0x20"`
+
+	ECSGeoIPDatabases []string            `toml:"ecs_geoip_databases"`
+	ECSGeoIPSubnets   map[string][]string `toml:"ecs_geoip_subnets"`
+
+	OCSPStaple              string   `toml:"ocsp_staple"`
+	TLSMinVersion           string   `toml:"tls_min_version"`
+	TLSCipherSuites         []string `toml:"tls_cipher_suites"`
+	TLSCurvePreferences     []string `toml:"tls_curve_preferences"`
+	TLSSessionTicketKeyFile string   `toml:"tls_session_ticket_key_file"`
+
+	ReadHeaderTimeout         uint `toml:"read_header_timeout"`
+	ReadTimeout               uint `toml:"read_timeout"`
+	WriteTimeout              uint `toml:"write_timeout"`
+	IdleTimeout               uint `toml:"idle_timeout"`
+	MaxHeaderBytes            int  `toml:"max_header_bytes"`
+	MaxConnections            int  `toml:"max_connections"`
+	MaxRequestsPerConn        int  `toml:"max_requests_per_connection"`
+	HTTP2MaxConcurrentStreams int  `toml:"http2_max_concurrent_streams"`
+	HTTP2MaxReadFrameSize     int  `toml:"http2_max_read_frame_size"`
+
+	AnyQueryPolicy              string   `toml:"any_query_policy"`
+	RefuseQtypes                []string `toml:"refuse_qtypes"`
+	NodataQtypes                []string `toml:"nodata_qtypes"`
+	ZoneTransferAllowClients    []string `toml:"zone_transfer_allow_clients"`
+	ZoneTransferAllowIdentities []string `toml:"zone_transfer_allow_identities"`
+	ZoneTransferTSIGKey         string   `toml:"zone_transfer_tsig_key"`
+	ZoneTransferTSIGAlgorithm   string   `toml:"zone_transfer_tsig_algorithm"`
+	ZoneTransferTSIGSecret      string   `toml:"zone_transfer_tsig_secret"`
+
+	DNS64        bool     `toml:"dns64"`
+	DNS64Prefix  string   `toml:"dns64_prefix"`
+	DNS64Clients []string `toml:"dns64_clients"`
+	DNS64Exclude []string `toml:"dns64_exclude"`
+
+	CacheSize           int  `toml:"cache_size"`
+	Prefetch            bool `toml:"prefetch"`
+	PrefetchPercent     uint `toml:"prefetch_percent"`
+	PrefetchMinHits     uint `toml:"prefetch_min_hits"`
+	PrefetchMaxInflight uint `toml:"prefetch_max_inflight"`
+
+	ServeStale               bool   `toml:"serve_stale"`
+	StaleAnswerWindow        uint32 `toml:"stale_answer_window"`
+	StaleAnswerTTL           uint32 `toml:"stale_answer_ttl"`
+	StaleAnswerClientTimeout uint   `toml:"stale_answer_client_timeout"`
+
+	MaxInflightQueries uint `toml:"max_inflight_queries"`
+	QueryQueueSize     uint `toml:"query_queue_size"`
+	QueryQueueTimeout  uint `toml:"query_queue_timeout"`
+
+	AuthTokenFile        string `toml:"auth_token_file"`
+	AuthTokenQuotaPeriod uint   `toml:"auth_token_quota_period"`
+	MetricsListen        string `toml:"metrics_listen"`
+
+	Listeners        []listenerConfig           `toml:"listener"`
+	Certificates     []certificateConfig        `toml:"certificate"`
+	UpstreamGroups   map[string][]string        `toml:"upstream_group"`
+	UpstreamOptions  map[string]*upstreamConfig `toml:"upstream_options"`
+	ClientIdentities []clientIdentityConfig     `toml:"client_identity"`
+	Profiles         map[string]*profileConfig  `toml:"profile"`
+	Endpoints        []endpointConfig           `toml:"endpoint"`
+	Rewrites         []rewriteConfig            `toml:"rewrite"`
+	Views            []viewConfig               `toml:"view"`
+}
+
+// listenerConfig describes one HTTP listen address. Options left empty fall
+// back to the flat options of the same name in the top-level config.
+type listenerConfig struct {
+	Listen           string   `toml:"listen"`
+	Cert             string   `toml:"cert"`
+	Key              string   `toml:"key"`
+	OCSPStaple       string   `toml:"ocsp_staple"`
+	TLSClientAuthCA  string   `toml:"tls_client_auth_ca"`
+	TLSClientAuthCRL string   `toml:"tls_client_auth_crl"`
+	Paths            []string `toml:"paths"`
+	AllowClients     []string `toml:"allow_clients"`
+	DenyClients      []string `toml:"deny_clients"`
+	TLSClientAuth    *bool    `toml:"tls_client_auth"`
+	TLS              *bool    `toml:"tls"`
+	RequireToken     *bool    `toml:"require_auth_token"`
+	Verbose          *bool    `toml:"verbose"`
+}
+
+// clientIdentityConfig applies options to clients whose TLS certificate has
+// one of Names as its common name or subject alternative name.
+type clientIdentityConfig struct {
+	Names         []string `toml:"names"`
+	UpstreamGroup string   `toml:"upstream_group"`
+	Profile       string   `toml:"profile"`
+}
+
+// profileConfig is a named set of policies applied to the requests of an
+// [[endpoint]] or a [[client_identity]].
+type profileConfig struct {
+	UpstreamGroup   string  `toml:"upstream_group"`
+	Blocklist       string  `toml:"blocklist"`
+	RateLimit       float64 `toml:"rate_limit"`
+	RateLimitBurst  uint    `toml:"rate_limit_burst"`
+	NoECS           bool    `toml:"no_ecs"`
+	ECSUsePreciseIP *bool   `toml:"ecs_use_precise_ip"`
+	ECSMode         string  `toml:"ecs_mode"`
+	ECSIPv4Prefix   uint    `toml:"ecs_ipv4_prefix"`
+	ECSIPv6Prefix   uint    `toml:"ecs_ipv6_prefix"`
+}
+
+// upstreamConfig holds settings for a single upstream, keyed by its address
+// as written in upstream lists, e.g. "udp:1.1.1.1:53".
+type upstreamConfig struct {
+	ECSMode       string `toml:"ecs_mode"`
+	ECSIPv4Prefix uint   `toml:"ecs_ipv4_prefix"`
+	ECSIPv6Prefix uint   `toml:"ecs_ipv6_prefix"`
+	DNS0x20       *bool  `toml:"dns0x20"`
+	Weight        int32  `toml:"weight"`
+
+	TSIGKey        string `toml:"tsig_key"`
+	TSIGAlgorithm  string `toml:"tsig_algorithm"`
+	TSIGSecretFile string `toml:"tsig_secret_file"`
+}
+
+// endpointConfig is an additional HTTP path served by every listener.
+type endpointConfig struct {
+	Path    string `toml:"path"`
+	Profile string `toml:"profile"`
+	// "json" to treat requests as application/dns-json, like Google's /resolve
+	Format string `toml:"format"`
+}
+
+// viewConfig is a split-horizon view for the clients in its networks or
+// with a matching TLS client certificate identity.
+type viewConfig struct {
+	Name          string   `toml:"name"`
+	Clients       []string `toml:"clients"`
+	Identities    []string `toml:"identities"`
+	UpstreamGroup string   `toml:"upstream_group"`
+	LocalZones    []string `toml:"local_zones"`
+	Blocklist     string   `toml:"blocklist"`
+}
+
+// rewriteConfig is a rule applied to responses before they are sent to the
+// client. Names and clients limit the queries it applies to.
+type rewriteConfig struct {
+	Names      []string          `toml:"names"`
+	Clients    []string          `toml:"clients"`
+	StripTypes []string          `toml:"strip_types"`
+	MinTTL     uint32            `toml:"min_ttl"`
+	MaxTTL     uint32            `toml:"max_ttl"`
+	Minimal    bool              `toml:"minimal"`
+	AddressMap map[string]string `toml:"address_map"`
+}
+
+// certificateConfig is one certificate served by SNI. If ServerNames is
+// empty, the names are taken from the certificate itself.
+type certificateConfig struct {
+	Cert          string   `toml:"cert"`
+	Key           string   `toml:"key"`
+	OCSPStaple    string   `toml:"ocsp_staple"`
+	Path          string   `toml:"path"`
+	UpstreamGroup string   `toml:"upstream_group"`
+	ServerNames   []string `toml:"server_names"`
+	Default       bool     `toml:"default"`
 }
 
 func loadConfig(path string) (*config, error) {
@@ -74,29 +255,393 @@ func loadConfig(path string) (*config, error) {
 	if conf.Tries == 0 {
 		conf.Tries = 1
 	}
+	if conf.ReadHeaderTimeout == 0 {
+		conf.ReadHeaderTimeout = 10
+	}
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = 30
+	}
+	if conf.WriteTimeout == 0 {
+		if conf.SplitTimeout {
+			conf.WriteTimeout = conf.Timeout + 10
+		} else {
+			// Leave enough time for every try to reach the upstream timeout
+			tries := conf.Tries + uint(len(conf.UpstreamGroups[conf.FallbackUpstreamGroup]))
+			conf.WriteTimeout = conf.Timeout*tries + 10
+		}
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = 120
+	}
+	if conf.CacheSize < 0 {
+		return nil, &configError{"cache_size must not be negative"}
+	}
+	if conf.Prefetch && conf.CacheSize == 0 {
+		return nil, &configError{"prefetch needs a cache, set cache_size"}
+	}
+	if conf.ServeStale && conf.CacheSize == 0 {
+		return nil, &configError{"serve_stale needs a cache, set cache_size"}
+	}
+	if conf.StaleAnswerWindow == 0 {
+		conf.StaleAnswerWindow = 86400
+	}
+	if conf.StaleAnswerTTL == 0 {
+		conf.StaleAnswerTTL = 30
+	}
+	if conf.PrefetchPercent == 0 {
+		conf.PrefetchPercent = 10
+	}
+	if conf.PrefetchPercent >= 100 {
+		return nil, &configError{"prefetch_percent must be below 100"}
+	}
+	if conf.PrefetchMinHits == 0 {
+		conf.PrefetchMinHits = 5
+	}
+	if conf.PrefetchMaxInflight == 0 {
+		conf.PrefetchMaxInflight = 10
+	}
+	if conf.TrustedProxies == nil {
+		conf.TrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+	}
+	for _, cidr := range conf.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, &configError{fmt.Sprintf("Invalid network %q in trusted_proxies", cidr)}
+		}
+	}
+	switch conf.UpstreamSelector {
+	case "":
+		conf.UpstreamSelector = "random"
+	case "random", "weighted_round_robin", "lvs_weighted_round_robin", "lowest_latency":
+		// OK
+	default:
+		return nil, &configError{"Invalid upstream_selector, choose one of: random weighted_round_robin lvs_weighted_round_robin lowest_latency"}
+	}
+	switch conf.AnyQueryPolicy {
+	case "":
+		conf.AnyQueryPolicy = "forward"
+	case "forward", "hinfo", "minimal":
+		// OK
+	default:
+		return nil, &configError{"Invalid any_query_policy, choose one of: forward hinfo minimal"}
+	}
+	for _, rcode := range conf.RetryRcodes {
+		if _, ok := dns.StringToRcode[rcode]; !ok {
+			return nil, &configError{fmt.Sprintf("Unknown rcode %q in retry_rcodes", rcode)}
+		}
+	}
+	for _, t := range append(conf.RefuseQtypes, conf.NodataQtypes...) {
+		if _, ok := dns.StringToType[t]; !ok {
+			return nil, &configError{fmt.Sprintf("Unknown query type %q", t)}
+		}
+	}
+	for _, cidr := range conf.ZoneTransferAllowClients {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, &configError{fmt.Sprintf("Invalid network %q in zone_transfer_allow_clients", cidr)}
+		}
+	}
+	if conf.ZoneTransferTSIGKey != "" {
+		conf.ZoneTransferTSIGKey = dns.CanonicalName(conf.ZoneTransferTSIGKey)
+		if conf.ZoneTransferTSIGAlgorithm == "" {
+			conf.ZoneTransferTSIGAlgorithm = dns.HmacSHA256
+		}
+		conf.ZoneTransferTSIGAlgorithm = dns.CanonicalName(conf.ZoneTransferTSIGAlgorithm)
+		if !validTSIGAlgorithm(conf.ZoneTransferTSIGAlgorithm) {
+			return nil, &configError{fmt.Sprintf("Unsupported zone_transfer_tsig_algorithm %q", conf.ZoneTransferTSIGAlgorithm)}
+		}
+		if _, err := base64.StdEncoding.DecodeString(conf.ZoneTransferTSIGSecret); err != nil || conf.ZoneTransferTSIGSecret == "" {
+			return nil, &configError{"zone_transfer_tsig_secret must be a base64-encoded key"}
+		}
+	}
+	if conf.DNS64 && len(conf.DNS64Clients) == 0 {
+		// Synthesized AAAA records break clients that have IPv4
+		return nil, &configError{"dns64 requires dns64_clients, e.g. [\"::/0\"] for all IPv6 clients"}
+	}
+	if conf.DNS64Prefix == "" {
+		conf.DNS64Prefix = "64:ff9b::/96"
+	}
+	_, dns64Prefix, err := net.ParseCIDR(conf.DNS64Prefix)
+	if err != nil || dns64Prefix.IP.To4() != nil {
+		return nil, &configError{fmt.Sprintf("Invalid dns64_prefix %q", conf.DNS64Prefix)}
+	}
+	switch ones, _ := dns64Prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+		// OK
+	default:
+		return nil, &configError{"dns64_prefix length must be one of: 32 40 48 56 64 96"}
+	}
+	if conf.DNS64Exclude == nil {
+		conf.DNS64Exclude = []string{"::ffff:0:0/96"}
+	}
+	for _, cidr := range append(conf.DNS64Clients, conf.DNS64Exclude...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, &configError{fmt.Sprintf("Invalid network %q in DNS64 configuration", cidr)}
+		}
+	}
+	if conf.QueryQueueTimeout == 0 {
+		conf.QueryQueueTimeout = 1
+	}
+	if conf.AuthTokenQuotaPeriod == 0 {
+		conf.AuthTokenQuotaPeriod = 86400
+	}
+	if conf.HTTP2MaxReadFrameSize != 0 && (conf.HTTP2MaxReadFrameSize < 16<<10 || conf.HTTP2MaxReadFrameSize > 16<<20) {
+		return nil, &configError{"http2_max_read_frame_size must be between 16384 and 16777216"}
+	}
 
 	if (conf.Cert != "") != (conf.Key != "") {
 		return nil, &configError{"You must specify both -cert and -key to enable TLS"}
 	}
 
+	if len(conf.Listeners) == 0 {
+		for _, addr := range conf.Listen {
+			conf.Listeners = append(conf.Listeners, listenerConfig{Listen: addr})
+		}
+	}
+	for i := range conf.Listeners {
+		l := &conf.Listeners[i]
+		if l.Listen == "" {
+			return nil, &configError{"Every [[listener]] must have a listen address"}
+		}
+		if l.Cert == "" && l.Key == "" {
+			l.Cert, l.Key = conf.Cert, conf.Key
+			if l.OCSPStaple == "" {
+				l.OCSPStaple = conf.OCSPStaple
+			}
+		}
+		if (l.Cert != "") != (l.Key != "") {
+			return nil, &configError{fmt.Sprintf("Listener %s must specify both cert and key to enable TLS", l.Listen)}
+		}
+		if l.TLSClientAuth == nil {
+			l.TLSClientAuth = &conf.TLSClientAuth
+		}
+		if l.TLSClientAuthCA == "" {
+			l.TLSClientAuthCA = conf.TLSClientAuthCA
+		}
+		if l.TLSClientAuthCRL == "" {
+			l.TLSClientAuthCRL = conf.TLSClientAuthCRL
+		}
+		if *l.TLSClientAuth && l.TLSClientAuthCA == "" {
+			return nil, &configError{fmt.Sprintf("TLS client authentication on listener %s requires both tls_client_auth and tls_client_auth_ca", l.Listen)}
+		}
+		if len(l.Paths) == 0 {
+			l.Paths = []string{conf.Path}
+			for _, e := range conf.Endpoints {
+				l.Paths = append(l.Paths, e.Path)
+			}
+		}
+		for _, cidr := range append(l.AllowClients, l.DenyClients...) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, &configError{fmt.Sprintf("Invalid client network %q on listener %s", cidr, l.Listen)}
+			}
+		}
+	}
+
 	// validate all upstreams
 	for _, us := range conf.Upstream {
-		address, t := addressAndType(us)
-		if address == "" {
-			return nil, &configError{"One of the upstreams has not a (udp|tcp|tcp-tls) prefix e.g. udp:1.1.1.1:53"}
+		if err := validateUpstream(us); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ECSMode == "" {
+		conf.ECSMode = "add"
+	}
+	if conf.ECSIPv4Prefix == 0 {
+		conf.ECSIPv4Prefix = 24
+		if conf.ECSUsePreciseIP {
+			conf.ECSIPv4Prefix = 32
+		}
+	}
+	if conf.ECSIPv6Prefix == 0 {
+		conf.ECSIPv6Prefix = 56
+		if conf.ECSUsePreciseIP {
+			conf.ECSIPv6Prefix = 128
+		}
+	}
+	if err := validateECS(conf, conf.ECSMode, conf.ECSIPv4Prefix, conf.ECSIPv6Prefix); err != nil {
+		return nil, err
+	}
+	for us, opts := range conf.UpstreamOptions {
+		if err := validateUpstream(us); err != nil {
+			return nil, err
+		}
+		if err := validateECS(conf, opts.ECSMode, opts.ECSIPv4Prefix, opts.ECSIPv6Prefix); err != nil {
+			return nil, err
+		}
+		if opts.Weight < 0 {
+			return nil, &configError{fmt.Sprintf("Negative weight for upstream %s", us)}
 		}
+		if (opts.TSIGKey == "") != (opts.TSIGSecretFile == "") {
+			return nil, &configError{fmt.Sprintf("Upstream %s needs both tsig_key and tsig_secret_file", us)}
+		}
+		if opts.TSIGKey != "" {
+			opts.TSIGKey = dns.CanonicalName(opts.TSIGKey)
+			if opts.TSIGAlgorithm == "" {
+				opts.TSIGAlgorithm = dns.HmacSHA256
+			}
+			opts.TSIGAlgorithm = dns.CanonicalName(opts.TSIGAlgorithm)
+			if !validTSIGAlgorithm(opts.TSIGAlgorithm) {
+				return nil, &configError{fmt.Sprintf("Unsupported tsig_algorithm %q for upstream %s", opts.TSIGAlgorithm, us)}
+			}
+		}
+	}
+	for name, group := range conf.UpstreamGroups {
+		if len(group) == 0 {
+			return nil, &configError{fmt.Sprintf("Upstream group %q is empty", name)}
+		}
+		for _, us := range group {
+			if err := validateUpstream(us); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if conf.MirrorUpstream != "" {
+		if err := validateUpstream(conf.MirrorUpstream); err != nil {
+			return nil, err
+		}
+		if conf.MirrorSampleRate < 0 || conf.MirrorSampleRate > 1 {
+			return nil, &configError{"mirror_sample_rate must be between 0 and 1"}
+		}
+		if conf.MirrorSampleRate == 0 {
+			conf.MirrorSampleRate = 1
+		}
+		if conf.MirrorLatencyThreshold == 0 {
+			conf.MirrorLatencyThreshold = 100
+		}
+		if conf.MirrorMaxInflight == 0 {
+			conf.MirrorMaxInflight = 100
+		}
+	}
+	if conf.FallbackUpstreamGroup != "" {
+		if _, ok := conf.UpstreamGroups[conf.FallbackUpstreamGroup]; !ok {
+			return nil, &configError{fmt.Sprintf("Unknown fallback_upstream_group %q", conf.FallbackUpstreamGroup)}
+		}
+	}
 
-		switch t {
-		case "tcp", "udp", "tcp-tls":
+	hasDefaultCert := false
+	for _, c := range conf.Certificates {
+		if c.Cert == "" || c.Key == "" {
+			return nil, &configError{"Every [[certificate]] must specify both cert and key"}
+		}
+		if c.Default {
+			if hasDefaultCert {
+				return nil, &configError{"Only one [[certificate]] can be the default"}
+			}
+			hasDefaultCert = true
+		}
+		if c.UpstreamGroup != "" {
+			if _, ok := conf.UpstreamGroups[c.UpstreamGroup]; !ok {
+				return nil, &configError{fmt.Sprintf("Certificate %s refers to unknown upstream group %q", c.Cert, c.UpstreamGroup)}
+			}
+		}
+	}
+	for name, p := range conf.Profiles {
+		if p.UpstreamGroup != "" {
+			if _, ok := conf.UpstreamGroups[p.UpstreamGroup]; !ok {
+				return nil, &configError{fmt.Sprintf("Profile %q refers to unknown upstream group %q", name, p.UpstreamGroup)}
+			}
+		}
+		if p.RateLimit < 0 {
+			return nil, &configError{fmt.Sprintf("Profile %q has a negative rate_limit", name)}
+		}
+		if err := validateECS(conf, p.ECSMode, p.ECSIPv4Prefix, p.ECSIPv6Prefix); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range conf.Endpoints {
+		if !strings.HasPrefix(e.Path, "/") {
+			return nil, &configError{fmt.Sprintf("Endpoint path %q must start with /", e.Path)}
+		}
+		if _, ok := conf.Profiles[e.Profile]; e.Profile != "" && !ok {
+			return nil, &configError{fmt.Sprintf("Endpoint %s refers to unknown profile %q", e.Path, e.Profile)}
+		}
+		switch e.Format {
+		case "", "json":
 			// OK
 		default:
-			return nil, &configError{"Invalid upstream prefix specified, choose one of: udp tcp tcp-tls"}
+			return nil, &configError{fmt.Sprintf("Invalid format %q for endpoint %s, choose one of: json", e.Format, e.Path)}
+		}
+	}
+	viewNames := make(map[string]bool)
+	for _, v := range conf.Views {
+		if v.Name == "" {
+			return nil, &configError{"Every view needs a name"}
+		}
+		if viewNames[v.Name] {
+			return nil, &configError{fmt.Sprintf("Duplicate view %q", v.Name)}
+		}
+		viewNames[v.Name] = true
+		for _, cidr := range v.Clients {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, &configError{fmt.Sprintf("Invalid network %q in view %q", cidr, v.Name)}
+			}
+		}
+		if v.UpstreamGroup != "" {
+			if _, ok := conf.UpstreamGroups[v.UpstreamGroup]; !ok {
+				return nil, &configError{fmt.Sprintf("View %q refers to unknown upstream group %q", v.Name, v.UpstreamGroup)}
+			}
+		}
+	}
+	for i, rw := range conf.Rewrites {
+		for _, cidr := range rw.Clients {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, &configError{fmt.Sprintf("Invalid network %q in rewrite rule %d", cidr, i+1)}
+			}
+		}
+		for _, t := range rw.StripTypes {
+			if _, ok := dns.StringToType[t]; !ok {
+				return nil, &configError{fmt.Sprintf("Unknown record type %q in rewrite rule %d", t, i+1)}
+			}
+		}
+		if rw.MaxTTL != 0 && rw.MinTTL > rw.MaxTTL {
+			return nil, &configError{fmt.Sprintf("min_ttl is greater than max_ttl in rewrite rule %d", i+1)}
+		}
+		for from, to := range rw.AddressMap {
+			fromIP, toIP := net.ParseIP(from), net.ParseIP(to)
+			if fromIP == nil || toIP == nil || (fromIP.To4() == nil) != (toIP.To4() == nil) {
+				return nil, &configError{fmt.Sprintf("Invalid address mapping %q = %q in rewrite rule %d, both must be addresses of the same family", from, to, i+1)}
+			}
+		}
+	}
+	for _, id := range conf.ClientIdentities {
+		if len(id.Names) == 0 {
+			return nil, &configError{"Every [[client_identity]] must have names"}
+		}
+		if _, ok := conf.Profiles[id.Profile]; id.Profile != "" && !ok {
+			return nil, &configError{fmt.Sprintf("Client identity %s refers to unknown profile %q", id.Names[0], id.Profile)}
+		}
+		if id.UpstreamGroup != "" {
+			if _, ok := conf.UpstreamGroups[id.UpstreamGroup]; !ok {
+				return nil, &configError{fmt.Sprintf("Client identity %s refers to unknown upstream group %q", id.Names[0], id.UpstreamGroup)}
+			}
+		}
+	}
+	for i := range conf.Listeners {
+		l := &conf.Listeners[i]
+		if l.TLS != nil && *l.TLS && l.Cert == "" && len(conf.Certificates) == 0 {
+			return nil, &configError{fmt.Sprintf("Listener %s has tls enabled but no certificate", l.Listen)}
+		}
+		if l.RequireToken != nil && *l.RequireToken && conf.AuthTokenFile == "" {
+			return nil, &configError{fmt.Sprintf("Listener %s requires auth tokens but auth_token_file is not set", l.Listen)}
 		}
 	}
 
 	return conf, nil
 }
 
+func validateUpstream(us string) error {
+	address, t := addressAndType(us)
+	if address == "" {
+		return &configError{"One of the upstreams has not a (udp|tcp|tcp-tls) prefix e.g. udp:1.1.1.1:53"}
+	}
+
+	switch t {
+	case "tcp", "udp", "tcp-tls":
+		// OK
+	default:
+		return &configError{"Invalid upstream prefix specified, choose one of: udp tcp tcp-tls"}
+	}
+	return nil
+}
+
 var rxUpstreamWithTypePrefix = regexp.MustCompile("^[a-z-]+(:)")
 
 func addressAndType(us string) (string, string) {
@@ -115,3 +660,31 @@ type configError struct {
 func (e *configError) Error() string {
 	return e.err
 }
+
+func validateECS(conf *config, mode string, ipv4Prefix, ipv6Prefix uint) error {
+	switch mode {
+	case "", "strip", "passthrough", "add", "override":
+		// OK
+	case "geoip":
+		if len(conf.ECSGeoIPDatabases) == 0 {
+			return &configError{"ecs_mode \"geoip\" requires ecs_geoip_databases"}
+		}
+	default:
+		return &configError{fmt.Sprintf("Invalid ecs_mode %q, choose one of: strip passthrough add override geoip", mode)}
+	}
+	if ipv4Prefix > 32 {
+		return &configError{"ecs_ipv4_prefix must not be greater than 32"}
+	}
+	if ipv6Prefix > 128 {
+		return &configError{"ecs_ipv6_prefix must not be greater than 128"}
+	}
+	return nil
+}
+
+func validTSIGAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		return true
+	}
+	return false
+}
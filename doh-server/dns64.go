@@ -0,0 +1,283 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/infobloxopen/go-trees/iptree"
+	"github.com/miekg/dns"
+)
+
+// TTL of synthesized records when the AAAA response carries no SOA record,
+// RFC 6147 Section 5.1.7
+const dns64DefaultNegativeTTL = 600
+
+// dns64 synthesizes AAAA records from A records for clients behind NAT64,
+// as described in RFC 6147.
+type dns64 struct {
+	prefix  *net.IPNet
+	clients *iptree.Tree
+	exclude *iptree.Tree
+}
+
+func newDNS64(conf *config) *dns64 {
+	if !conf.DNS64 {
+		return nil
+	}
+	_, prefix, _ := net.ParseCIDR(conf.DNS64Prefix)
+	return &dns64{
+		prefix:  prefix,
+		clients: newNetworkTree(conf.DNS64Clients),
+		exclude: newNetworkTree(conf.DNS64Exclude),
+	}
+}
+
+// appliesTo reports whether DNS64 is enabled for the client, which must be in
+// one of the dns64_clients networks.
+func (d *dns64) appliesTo(r *http.Request) bool {
+	if d == nil || d.clients == nil {
+		return false
+	}
+	ip := clientAddr(r)
+	if ip == nil {
+		return false
+	}
+	_, ok := d.clients.GetByIP(ip)
+	return ok
+}
+
+func (d *dns64) excluded(ip net.IP) bool {
+	if d.exclude == nil {
+		return false
+	}
+	_, ok := d.exclude.GetByIP(ip)
+	return ok
+}
+
+// embedIPv4 builds the IPv4-embedded IPv6 address of v4 within prefix,
+// following RFC 6052 Section 2.2. Bits 64 to 71 are left as zero.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extractIPv4 returns the IPv4 address embedded in ip, or nil if ip is not
+// within prefix.
+func extractIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	v4 := make(net.IP, net.IPv4len)
+	for i := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		v4[i] = ip[pos]
+		pos++
+	}
+	return v4
+}
+
+// parseIP6Arpa converts a full-length name under ip6.arpa to the address it
+// stands for, or returns nil.
+func parseIP6Arpa(name string) net.IP {
+	name, ok := strings.CutSuffix(strings.ToLower(dns.Fqdn(name)), ".ip6.arpa.")
+	if !ok {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) != 2*net.IPv6len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, label := range labels {
+		if len(label) != 1 {
+			return nil
+		}
+		var nibble byte
+		switch c := label[0]; {
+		case c >= '0' && c <= '9':
+			nibble = c - '0'
+		case c >= 'a' && c <= 'f':
+			nibble = c - 'a' + 10
+		default:
+			return nil
+		}
+		// Labels run from the least significant nibble
+		pos := len(labels) - 1 - i
+		if pos%2 == 0 {
+			ip[pos/2] |= nibble << 4
+		} else {
+			ip[pos/2] |= nibble
+		}
+	}
+	return ip
+}
+
+// doDNS64Query resolves the request like doDNSQuery, synthesizing AAAA
+// records when the name has none, and answering PTR queries for synthesized
+// addresses from the in-addr.arpa tree.
+func (s *Server) doDNS64Query(ctx context.Context, req *DNSRequest) error {
+	if len(req.request.Question) == 0 || req.request.Question[0].Qclass != dns.ClassINET {
+		return s.doDNSQuery(ctx, req)
+	}
+	question := req.request.Question[0]
+
+	if question.Qtype == dns.TypePTR {
+		if v4 := extractIPv4(s.dns64.prefix, parseIP6Arpa(question.Name)); v4 != nil {
+			return s.doDNS64PTRQuery(ctx, req, v4)
+		}
+	}
+
+	if err := s.doDNSQuery(ctx, req); err != nil {
+		return err
+	}
+	// A validating client would reject synthesized records, RFC 6147
+	// Section 5.5.
+	if question.Qtype != dns.TypeAAAA || req.request.CheckingDisabled || req.response.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// AAAA records in excluded ranges are treated as nonexistent.
+	answer := make([]dns.RR, 0, len(req.response.Answer))
+	var haveAAAA bool
+	for _, rr := range req.response.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			if s.dns64.excluded(aaaa.AAAA) {
+				continue
+			}
+			haveAAAA = true
+		}
+		answer = append(answer, rr)
+	}
+	if haveAAAA {
+		req.response.Answer = answer
+		return nil
+	}
+
+	ttl := uint32(dns64DefaultNegativeTTL)
+	for _, rr := range req.response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	aReq := *req
+	aReq.request = req.request.Copy()
+	aReq.request.Id = dns.Id()
+	aReq.request.Question[0].Qtype = dns.TypeA
+	if err := s.doDNSQuery(ctx, &aReq); err != nil {
+		log.Printf("DNS64 A query for %s failed: %v\n", question.Name, err)
+		return nil
+	}
+	if aReq.response.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	answer = answer[:0]
+	var synthesized bool
+	for _, rr := range aReq.response.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if s.dns64.excluded(rr.A) {
+				continue
+			}
+			answer = append(answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   rr.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  rr.Hdr.Class,
+					Ttl:    min(rr.Hdr.Ttl, ttl),
+				},
+				AAAA: embedIPv4(s.dns64.prefix, rr.A),
+			})
+			synthesized = true
+		case *dns.CNAME, *dns.DNAME:
+			answer = append(answer, rr)
+		}
+	}
+	if !synthesized {
+		return nil
+	}
+
+	resp := aReq.response
+	resp.Question = req.request.Question
+	resp.Answer = answer
+	resp.Ns = nil
+	resp.AuthenticatedData = false
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	req.response = resp
+	req.currentUpstream = aReq.currentUpstream
+	return nil
+}
+
+// doDNS64PTRQuery answers a reverse query for a synthesized address with the
+// PTR records of the embedded IPv4 address, RFC 6147 Section 5.3.1.
+func (s *Server) doDNS64PTRQuery(ctx context.Context, req *DNSRequest, v4 net.IP) error {
+	target, err := dns.ReverseAddr(v4.String())
+	if err != nil {
+		return err
+	}
+	ptrReq := *req
+	ptrReq.request = req.request.Copy()
+	ptrReq.request.Question[0].Name = target
+	if err := s.doDNSQuery(ctx, &ptrReq); err != nil {
+		return err
+	}
+
+	resp := ptrReq.response
+	resp.Question = req.request.Question
+	for _, rr := range resp.Answer {
+		if strings.EqualFold(rr.Header().Name, target) {
+			rr.Header().Name = req.request.Question[0].Name
+		}
+	}
+	req.response = resp
+	req.currentUpstream = ptrReq.currentUpstream
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	t.Parallel()
+	// Examples from RFC 6052 Section 2.4
+	v4 := net.ParseIP("192.0.2.33")
+	for _, tc := range []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	} {
+		_, prefix, err := net.ParseCIDR(tc.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := embedIPv4(prefix, v4)
+		if !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("embedIPv4(%s) = %s, want %s", tc.prefix, got, tc.want)
+		}
+		if back := extractIPv4(prefix, got); !back.Equal(v4) {
+			t.Errorf("extractIPv4(%s, %s) = %s, want %s", tc.prefix, got, back, v4)
+		}
+	}
+
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	if got := extractIPv4(prefix, net.ParseIP("2001:db8::1")); got != nil {
+		t.Errorf("extractIPv4 outside the prefix = %s, want nil", got)
+	}
+}
+
+func TestParseIP6Arpa(t *testing.T) {
+	t.Parallel()
+	want := net.ParseIP("64:ff9b::c000:221")
+	name, err := dns.ReverseAddr(want.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseIP6Arpa(name); !got.Equal(want) {
+		t.Errorf("parseIP6Arpa(%s) = %s, want %s", name, got, want)
+	}
+	for _, name := range []string{
+		"b.9.f.f.4.6.0.0.ip6.arpa.",
+		"1.0.0.127.in-addr.arpa.",
+		"example.com.",
+	} {
+		if got := parseIP6Arpa(name); got != nil {
+			t.Errorf("parseIP6Arpa(%s) = %s, want nil", name, got)
+		}
+	}
+}
+
+func TestDNS64RequiresClients(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "doh-server.conf")
+	if err := os.WriteFile(path, []byte("upstream = [\"udp:127.0.0.1:53\"]\ndns64 = true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadConfig(path)
+	var confErr *configError
+	if !errors.As(err, &confErr) {
+		t.Fatalf("loadConfig: got %v, want a configError", err)
+	}
+}
+
+func TestDNS64AppliesTo(t *testing.T) {
+	t.Parallel()
+	d := newDNS64(&config{
+		DNS64:        true,
+		DNS64Prefix:  "64:ff9b::/96",
+		DNS64Clients: []string{"2001:db8::/32"},
+	})
+	tests := []struct {
+		remote string
+		want   bool
+	}{
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db9::1]:1234", false},
+		{"192.0.2.1:1234", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/dns-query", nil)
+		r.RemoteAddr = tt.remote
+		if got := d.appliesTo(r); got != tt.want {
+			t.Errorf("appliesTo(%s) = %v, want %v", tt.remote, got, tt.want)
+		}
+	}
+
+	if (&dns64{}).appliesTo(httptest.NewRequest("GET", "/dns-query", nil)) {
+		t.Error("appliesTo with no client networks = true, want false")
+	}
+}
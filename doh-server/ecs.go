@@ -0,0 +1,157 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ecsPolicy decides what EDNS Client Subnet option (RFC 7871) is sent to an
+// upstream.
+//
+// Modes:
+//
+//	strip        remove any ECS option
+//	passthrough  forward the client's ECS option, never add one
+//	add          forward the client's ECS option, or add one from the
+//	             client's address if there is none
+//	override     replace any ECS option with one from the client's address
+//	geoip        replace any ECS option with a subnet representing the
+//	             client's autonomous system or country
+type ecsPolicy struct {
+	mode       string
+	ipv4Prefix uint8
+	ipv6Prefix uint8
+	geoip      *geoIPMapper
+}
+
+// ecsPolicyFor returns the ECS policy of an upstream for the profile of the
+// request. The profile's settings take precedence over the upstream's, which
+// take precedence over the global ones.
+func (s *Server) ecsPolicyFor(ctx context.Context, upstream string) ecsPolicy {
+	p := ecsPolicy{
+		mode:       s.conf.ECSMode,
+		ipv4Prefix: uint8(s.conf.ECSIPv4Prefix),
+		ipv6Prefix: uint8(s.conf.ECSIPv6Prefix),
+		geoip:      s.geoip,
+	}
+	if opts := s.conf.UpstreamOptions[upstream]; opts != nil {
+		p.override(opts.ECSMode, opts.ECSIPv4Prefix, opts.ECSIPv6Prefix)
+	}
+	if prof, _ := ctx.Value(profileContextKey{}).(*profile); prof != nil {
+		p.override(prof.conf.ECSMode, prof.conf.ECSIPv4Prefix, prof.conf.ECSIPv6Prefix)
+		if prof.conf.ECSUsePreciseIP != nil && *prof.conf.ECSUsePreciseIP {
+			p.ipv4Prefix, p.ipv6Prefix = 32, 128
+		}
+	}
+	return p
+}
+
+// override replaces the settings that are set, i.e. not empty or zero.
+func (p *ecsPolicy) override(mode string, ipv4Prefix, ipv6Prefix uint) {
+	if mode != "" {
+		p.mode = mode
+	}
+	if ipv4Prefix != 0 {
+		p.ipv4Prefix = uint8(ipv4Prefix)
+	}
+	if ipv6Prefix != 0 {
+		p.ipv6Prefix = uint8(ipv6Prefix)
+	}
+}
+
+// apply returns a copy of msg with the ECS option set according to the
+// policy, and whether that option was derived from clientIP.
+func (p ecsPolicy) apply(msg *dns.Msg, clientIP net.IP) (*dns.Msg, bool) {
+	msg = msg.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		if p.mode == "strip" || p.mode == "passthrough" || clientIP == nil {
+			return msg, false
+		}
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		msg.Extra = append([]dns.RR{opt}, msg.Extra...)
+	}
+
+	var clientSubnet *dns.EDNS0_SUBNET
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			clientSubnet = subnet
+			continue
+		}
+		options = append(options, option)
+	}
+	opt.Option = options
+
+	switch p.mode {
+	case "strip":
+		return msg, false
+	case "passthrough", "add":
+		if clientSubnet != nil {
+			opt.Option = append(opt.Option, clientSubnet)
+			return msg, false
+		}
+		if p.mode == "passthrough" {
+			return msg, false
+		}
+	}
+
+	if clientIP == nil {
+		return msg, false
+	}
+	subnet := &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET,
+	}
+	if p.mode == "geoip" {
+		// Without a substitute, send nothing rather than the real prefix.
+		substitute := p.geoip.substitute(clientIP)
+		if substitute == nil {
+			return msg, false
+		}
+		ones, bits := substitute.Mask.Size()
+		subnet.Family = 2
+		if bits == 32 {
+			subnet.Family = 1
+		}
+		subnet.SourceNetmask = uint8(ones)
+		subnet.Address = substitute.IP
+	} else if ipv4 := clientIP.To4(); ipv4 != nil {
+		subnet.Family = 1
+		subnet.SourceNetmask = p.ipv4Prefix
+		subnet.Address = ipv4.Mask(net.CIDRMask(int(p.ipv4Prefix), 32))
+	} else {
+		subnet.Family = 2
+		subnet.SourceNetmask = p.ipv6Prefix
+		subnet.Address = clientIP.Mask(net.CIDRMask(int(p.ipv6Prefix), 128))
+	}
+	opt.Option = append(opt.Option, subnet)
+	return msg, true
+}
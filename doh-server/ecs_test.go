@@ -0,0 +1,114 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestECSPolicy(t *testing.T) {
+	t.Parallel()
+	clientIP := net.ParseIP("198.51.100.77")
+	withSubnet := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 16,
+			Address:       net.ParseIP("203.0.0.0").To4(),
+		})
+		return msg
+	}
+	withoutSubnet := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		return msg
+	}
+
+	for _, tc := range []struct {
+		mode     string
+		msg      *dns.Msg
+		want     string
+		tailored bool
+	}{
+		{"strip", withSubnet(), "", false},
+		{"passthrough", withSubnet(), "203.0.0.0/16", false},
+		{"passthrough", withoutSubnet(), "", false},
+		{"add", withSubnet(), "203.0.0.0/16", false},
+		{"add", withoutSubnet(), "198.51.100.0/24", true},
+		{"override", withSubnet(), "198.51.100.0/24", true},
+	} {
+		p := ecsPolicy{mode: tc.mode, ipv4Prefix: 24, ipv6Prefix: 56}
+		query, tailored := p.apply(tc.msg, clientIP)
+		got := ""
+		for _, option := range query.IsEdns0().Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				got = (&net.IPNet{IP: subnet.Address, Mask: net.CIDRMask(int(subnet.SourceNetmask), 32)}).String()
+			}
+		}
+		if got != tc.want || tailored != tc.tailored {
+			t.Errorf("mode %s: got subnet %q tailored %v, want %q %v", tc.mode, got, tailored, tc.want, tc.tailored)
+		}
+	}
+}
+
+func TestECSPolicyFor(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{conf: &config{
+		ECSMode:       "add",
+		ECSIPv4Prefix: 24,
+		ECSIPv6Prefix: 56,
+		UpstreamOptions: map[string]*upstreamConfig{
+			"udp:192.0.2.53:53": {ECSMode: "override", ECSIPv4Prefix: 20},
+		},
+	}}
+	private := &profile{conf: &profileConfig{ECSMode: "strip"}}
+	coarse := &profile{conf: &profileConfig{ECSIPv6Prefix: 48}}
+	withProfile := func(p *profile) context.Context {
+		return context.WithValue(context.Background(), profileContextKey{}, p)
+	}
+
+	for _, tc := range []struct {
+		ctx      context.Context
+		upstream string
+		want     ecsPolicy
+	}{
+		{context.Background(), "udp:198.51.100.53:53", ecsPolicy{mode: "add", ipv4Prefix: 24, ipv6Prefix: 56}},
+		{context.Background(), "udp:192.0.2.53:53", ecsPolicy{mode: "override", ipv4Prefix: 20, ipv6Prefix: 56}},
+		{withProfile(private), "udp:192.0.2.53:53", ecsPolicy{mode: "strip", ipv4Prefix: 20, ipv6Prefix: 56}},
+		{withProfile(coarse), "udp:192.0.2.53:53", ecsPolicy{mode: "override", ipv4Prefix: 20, ipv6Prefix: 48}},
+	} {
+		if got := s.ecsPolicyFor(tc.ctx, tc.upstream); got != tc.want {
+			t.Errorf("upstream %s: got %+v, want %+v", tc.upstream, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPRecord holds the fields read from MaxMind-format databases. Country
+// databases fill in the country, ASN databases the autonomous system.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoIPMapper maps client addresses to representative subnets of their
+// autonomous system or country, to be sent as EDNS Client Subnet instead of
+// the client's own prefix.
+type geoIPMapper struct {
+	paths   []string
+	files   []*watchedFile
+	mu      sync.RWMutex
+	readers []*maxminddb.Reader
+	// Substitute subnets keyed by "AS<number>", ISO country code or
+	// "default"
+	subnets map[string][]*net.IPNet
+}
+
+func newGeoIPMapper(paths []string, subnets map[string][]string) (*geoIPMapper, error) {
+	m := &geoIPMapper{
+		paths:   paths,
+		subnets: make(map[string][]*net.IPNet, len(subnets)),
+	}
+	for key, cidrs := range subnets {
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, &configError{fmt.Sprintf("Invalid network %q in ecs_geoip_subnets", cidr)}
+			}
+			m.subnets[key] = append(m.subnets[key], ipNet)
+		}
+	}
+	for _, path := range paths {
+		m.files = append(m.files, newWatchedFile(path))
+	}
+	readers, err := loadGeoIPDatabases(paths)
+	if err != nil {
+		return nil, err
+	}
+	m.readers = readers
+	return m, nil
+}
+
+func loadGeoIPDatabases(paths []string) ([]*maxminddb.Reader, error) {
+	readers := make([]*maxminddb.Reader, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("loading GeoIP database %s: %w", path, err)
+		}
+		readers = append(readers, reader)
+	}
+	return readers, nil
+}
+
+// watch reloads the databases whenever one of them changes. The databases
+// can be large, so this is not done on the request path.
+func (m *geoIPMapper) watch() {
+	for {
+		time.Sleep(fileCheckInterval)
+		var changed bool
+		for _, f := range m.files {
+			// Check every file, so that none is left reporting a stale
+			// change.
+			if f.changed() {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		readers, err := loadGeoIPDatabases(m.paths)
+		if err != nil {
+			log.Printf("Error reloading GeoIP databases: %v\n", err)
+			continue
+		}
+		m.mu.Lock()
+		m.readers = readers
+		m.mu.Unlock()
+	}
+}
+
+// substitute returns the subnet to send in place of ip, preferring the
+// client's autonomous system over its country, or nil if there is none of
+// the same address family.
+func (m *geoIPMapper) substitute(ip net.IP) *net.IPNet {
+	var record geoIPRecord
+	m.mu.RLock()
+	for _, reader := range m.readers {
+		if err := reader.Lookup(ip, &record); err != nil {
+			log.Printf("GeoIP lookup for %s failed: %v\n", ip, err)
+		}
+	}
+	m.mu.RUnlock()
+
+	isIPv4 := ip.To4() != nil
+	for _, key := range []string{"AS" + strconv.FormatUint(uint64(record.ASN), 10), record.Country.ISOCode, "default"} {
+		if key == "AS0" || key == "" {
+			continue
+		}
+		for _, subnet := range m.subnets[key] {
+			if (subnet.IP.To4() != nil) == isIPv4 {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGeoIPSubstitute(t *testing.T) {
+	t.Parallel()
+
+	// The country database has 192.0.2.0/24, 198.51.100.0/24 and
+	// 2001:db8:de::/48 in DE, 2001:db8:f::/48 in FR. The ASN database has
+	// 192.0.2.0/24 in AS64500.
+	m, err := newGeoIPMapper([]string{"testdata/geoip-country.mmdb", "testdata/geoip-asn.mmdb"}, map[string][]string{
+		"AS64500": {"203.0.113.0/24"},
+		"DE":      {"10.49.0.0/16"},
+		"FR":      {"10.33.0.0/16", "2001:db8:33::/48"},
+		"default": {"10.0.0.0/24", "fd00::/64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip, subnet string
+	}{
+		{"192.0.2.1", "203.0.113.0/24"},
+		{"198.51.100.1", "10.49.0.0/16"},
+		{"2001:db8:f::1", "2001:db8:33::/48"},
+		// DE has no IPv6 subnet
+		{"2001:db8:de::1", "fd00::/64"},
+		{"203.0.113.1", "10.0.0.0/24"},
+		{"2001:db8:ffff::1", "fd00::/64"},
+	} {
+		if got := m.substitute(net.ParseIP(tt.ip)); got == nil || got.String() != tt.subnet {
+			t.Errorf("substitute(%s) = %v, want %s", tt.ip, got, tt.subnet)
+		}
+	}
+}
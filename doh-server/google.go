@@ -100,18 +100,6 @@ func (s *Server) parseRequestGoogle(ctx context.Context, w http.ResponseWriter,
 				errtext: err.Error(),
 			}
 		}
-	} else {
-		ednsClientAddress = s.findClientIP(r)
-		if ednsClientAddress == nil {
-			ednsClientNetmask = 0
-		} else if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-			ednsClientFamily = 1
-			ednsClientAddress = ipv4
-			ednsClientNetmask = 24
-		} else {
-			ednsClientFamily = 2
-			ednsClientNetmask = 56
-		}
 	}
 
 	msg := new(dns.Msg)
@@ -27,6 +27,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
@@ -66,7 +67,7 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 		}
 	}
 
-	if s.patchDNSCryptProxyReqID(w, r, requestBinary) {
+	if s.patchDNSCryptProxyReqID(ctx, w, r, requestBinary) {
 		return &DNSRequest{
 			errcode: 444,
 		}
@@ -75,13 +76,19 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 	msg := new(dns.Msg)
 	err = msg.Unpack(requestBinary)
 	if err != nil {
-		return &DNSRequest{
+		req := &DNSRequest{
 			errcode: 400,
 			errtext: fmt.Sprintf("DNS packet parse failure (%s)", err.Error()),
 		}
+		if len(requestBinary) >= 2 {
+			// Enough to answer with FORMERR
+			req.transactionID = binary.BigEndian.Uint16(requestBinary)
+			req.request = new(dns.Msg)
+		}
+		return req
 	}
 
-	if s.conf.Verbose && len(msg.Question) > 0 {
+	if s.isVerbose(ctx) && len(msg.Question) > 0 {
 		question := &msg.Question[0]
 		questionName := question.Name
 		questionClass := ""
@@ -100,16 +107,38 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 		if s.conf.LogGuessedIP {
 			clientip = s.findClientIP(r)
 		}
+		user := "-"
+		if token := authTokenFromContext(ctx); token != nil {
+			user = token.label
+		} else if id := clientIdentityFromRequest(r); id != nil {
+			user = id.String()
+		}
+		viewName := "-"
+		if v := viewFromContext(ctx); v != nil {
+			viewName = v.name
+		}
 		if clientip != nil {
-			fmt.Printf("%s - - [%s] \"%s %s %s\"\n", clientip, time.Now().Format("02/Jan/2006:15:04:05 -0700"), questionName, questionClass, questionType)
+			fmt.Printf("%s - %s [%s] \"%s %s %s\" %s\n", clientip, user, time.Now().Format("02/Jan/2006:15:04:05 -0700"), questionName, questionClass, questionType, viewName)
 		} else {
-			fmt.Printf("%s - - [%s] \"%s %s %s\"\n", r.RemoteAddr, time.Now().Format("02/Jan/2006:15:04:05 -0700"), questionName, questionClass, questionType)
+			fmt.Printf("%s - %s [%s] \"%s %s %s\" %s\n", r.RemoteAddr, user, time.Now().Format("02/Jan/2006:15:04:05 -0700"), questionName, questionClass, questionType, viewName)
 		}
 	}
 
 	transactionID := msg.Id
 	msg.Id = dns.Id()
 	opt := msg.IsEdns0()
+	// Remember what the client sent before the OPT record is changed.
+	clientEDNS := opt != nil
+	var clientPadding bool
+	var clientUDPSize uint16
+	if clientEDNS {
+		clientUDPSize = opt.UDPSize()
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0PADDING {
+				clientPadding = true
+			}
+		}
+	}
 	if opt == nil {
 		opt = new(dns.OPT)
 		opt.Hdr.Name = "."
@@ -127,49 +156,20 @@ func (s *Server) parseRequestIETF(ctx context.Context, w http.ResponseWriter, r
 	}
 	isTailored := edns0Subnet == nil
 
-	if edns0Subnet == nil {
-		ednsClientFamily := uint16(0)
-		ednsClientAddress := s.findClientIP(r)
-		ednsClientNetmask := uint8(255)
-		if ednsClientAddress != nil {
-			if ipv4 := ednsClientAddress.To4(); ipv4 != nil {
-				ednsClientFamily = 1
-				ednsClientAddress = ipv4
-				if s.conf.ECSUsePreciseIP {
-					ednsClientNetmask = 32
-				} else {
-					ednsClientNetmask = 24
-					ednsClientAddress = ednsClientAddress.Mask(net.CIDRMask(24, 32))
-				}
-			} else {
-				ednsClientFamily = 2
-				if s.conf.ECSUsePreciseIP {
-					ednsClientNetmask = 128
-				} else {
-					ednsClientNetmask = 56
-					ednsClientAddress = ednsClientAddress.Mask(net.CIDRMask(56, 128))
-				}
-			}
-			edns0Subnet = new(dns.EDNS0_SUBNET)
-			edns0Subnet.Code = dns.EDNS0SUBNET
-			edns0Subnet.Family = ednsClientFamily
-			edns0Subnet.SourceNetmask = ednsClientNetmask
-			edns0Subnet.SourceScope = 0
-			edns0Subnet.Address = ednsClientAddress
-			opt.Option = append(opt.Option, edns0Subnet)
-		}
-	}
-
 	return &DNSRequest{
 		request:       msg,
 		transactionID: transactionID,
 		isTailored:    isTailored,
+		clientEDNS:    clientEDNS,
+		clientPadding: clientPadding,
+		clientUDPSize: clientUDPSize,
 	}
 }
 
 func (s *Server) generateResponseIETF(ctx context.Context, w http.ResponseWriter, r *http.Request, req *DNSRequest) {
 	respJSON := jsondns.Marshal(req.response)
 	req.response.Id = req.transactionID
+	s.padResponse(r, req)
 	respBytes, err := req.response.Pack()
 	if err != nil {
 		log.Printf("DNS packet construct failure with upstream %s: %v\n", req.currentUpstream, err)
@@ -192,9 +192,10 @@ func (s *Server) generateResponseIETF(ctx context.Context, w http.ResponseWriter
 		w.Header().Set("Expires", respJSON.EarliestExpires.Format(http.TimeFormat))
 	}
 
-	if respJSON.Status == dns.RcodeServerFailure {
+	// DNS errors are answered with HTTP 200, RFC 8484 Section 4.2.1. Stub
+	// resolvers take HTTP errors as a broken server.
+	if respJSON.Status == dns.RcodeServerFailure && req.currentUpstream != "" {
 		log.Printf("received server failure from upstream %s: %v\n", req.currentUpstream, req.response)
-		w.WriteHeader(503)
 	}
 	_, err = w.Write(respBytes)
 	if err != nil {
@@ -202,10 +203,33 @@ func (s *Server) generateResponseIETF(ctx context.Context, w http.ResponseWriter
 	}
 }
 
+// generateErrorResponseIETF answers the request with rcode and, if the client
+// uses EDNS, an Extended DNS Error (RFC 8914) instead of a response from
+// upstream.
+func (s *Server) generateErrorResponseIETF(ctx context.Context, w http.ResponseWriter, r *http.Request, req *DNSRequest, rcode int, infoCode uint16, extraText string) {
+	msg := new(dns.Msg)
+	msg.SetRcode(req.request, rcode)
+	msg.RecursionAvailable = true
+	// Without EDNS in the query, there must be no OPT record in the response.
+	if req.clientEDNS {
+		opt := new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  infoCode,
+			ExtraText: extraText,
+		})
+		msg.Extra = append(msg.Extra, opt)
+	}
+	req.response = msg
+	s.generateResponseIETF(ctx, w, r, req)
+}
+
 // Workaround a bug causing DNSCrypt-Proxy to expect a response with TransactionID = 0xcafe.
-func (s *Server) patchDNSCryptProxyReqID(w http.ResponseWriter, r *http.Request, requestBinary []byte) bool {
+func (s *Server) patchDNSCryptProxyReqID(ctx context.Context, w http.ResponseWriter, r *http.Request, requestBinary []byte) bool {
 	if strings.Contains(r.UserAgent(), "dnscrypt-proxy") && bytes.Equal(requestBinary, []byte("\xca\xfe\x01\x00\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x02\x00\x01\x00\x00\x29\x10\x00\x00\x00\x80\x00\x00\x00")) {
-		if s.conf.Verbose {
+		if s.isVerbose(ctx) {
 			log.Println("DNSCrypt-Proxy detected. Patching response.")
 		}
 		w.Header().Set("Content-Type", "application/dns-message")
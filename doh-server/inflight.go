@@ -0,0 +1,104 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errOverloaded is returned for queries that did not get a slot from the
+// query limiter.
+var errOverloaded = errors.New("server overloaded")
+
+// queryLimiter caps the number of upstream queries in flight. Requests over
+// the cap wait in a short queue, and are shed when the queue is full or they
+// have waited too long.
+type queryLimiter struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	maxQueue int64
+	timeout  time.Duration
+}
+
+func newQueryLimiter(maxInflight, maxQueue uint, timeout time.Duration) *queryLimiter {
+	return &queryLimiter{
+		slots:    make(chan struct{}, maxInflight),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+	}
+}
+
+// acquire reserves a slot for an upstream query and reports whether it got
+// one. Every successful acquire must be followed by release.
+func (ql *queryLimiter) acquire(ctx context.Context) bool {
+	select {
+	case ql.slots <- struct{}{}:
+		metricInflightQueries.Add(1)
+		return true
+	default:
+	}
+
+	if ql.queued.Add(1) > ql.maxQueue {
+		ql.queued.Add(-1)
+		metricShedQueries.Add(1)
+		return false
+	}
+	metricQueuedQueries.Add(1)
+	defer func() {
+		ql.queued.Add(-1)
+		metricQueuedQueries.Add(-1)
+	}()
+
+	timer := time.NewTimer(ql.timeout)
+	defer timer.Stop()
+	select {
+	case ql.slots <- struct{}{}:
+		metricInflightQueries.Add(1)
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	metricShedQueries.Add(1)
+	return false
+}
+
+func (ql *queryLimiter) release() {
+	<-ql.slots
+	metricInflightQueries.Add(-1)
+}
+
+// limitedQueryUpstream sends req to upstream once it gets a slot from the
+// query limiter.
+func (s *Server) limitedQueryUpstream(ctx context.Context, req *DNSRequest) error {
+	if s.limiter != nil {
+		if !s.limiter.acquire(ctx) {
+			return errOverloaded
+		}
+		defer s.limiter.release()
+	}
+	return s.queryUpstream(ctx, req)
+}
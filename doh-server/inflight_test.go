@@ -0,0 +1,107 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLimiterShedding(t *testing.T) {
+	t.Parallel()
+
+	unblock := make(chan struct{})
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-unblock
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		w.WriteMsg(resp)
+	})
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+timeout = 10
+max_inflight_queries = 1
+query_queue_size = 1
+query_queue_timeout = 10
+`, upstream))
+	wireRequest := func(name string) *http.Request {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+	}
+
+	// One query takes the only slot, the next one waits in the queue.
+	var wg sync.WaitGroup
+	for _, name := range []string{"slot.example.", "queued.example."} {
+		r := wireRequest(name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handlerFunc(httptest.NewRecorder(), r)
+		}()
+	}
+	defer wg.Wait()
+	defer close(unblock)
+	for deadline := time.Now().Add(5 * time.Second); s.limiter.queued.Load() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("the second query was not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queued := metricQueuedQueries.Value(); queued < 1 {
+		t.Errorf("queued_queries = %d, want at least 1", queued)
+	}
+
+	w := httptest.NewRecorder()
+	s.handlerFunc(w, wireRequest("shed.example."))
+	resp := new(dns.Msg)
+	if err := resp.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("shed wire-format query not answered in DNS: %v", err)
+	}
+	opt := resp.IsEdns0()
+	if resp.Rcode != dns.RcodeServerFailure || opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0EDE {
+		t.Errorf("unexpected response to a shed query:\n%v", resp)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("shed wire-format query has no Retry-After header")
+	}
+
+	w = httptest.NewRecorder()
+	s.handlerFunc(w, httptest.NewRequest(http.MethodGet, "/resolve?name=shed.example.&type=A", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("JSON query: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
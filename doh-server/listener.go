@@ -0,0 +1,401 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/infobloxopen/go-trees/iptree"
+
+	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+)
+
+// listener is a single HTTP endpoint with its own TLS material and policy.
+type listener struct {
+	conf      *listenerConfig
+	server    *http.Server
+	paths     map[string]struct{}
+	allow     *iptree.Tree
+	deny      *iptree.Tree
+	certs     *certStore
+	ownCert   *certificate
+	verbose   bool
+	enableTLS bool
+
+	maxRequestsPerConn int64
+	connSem            chan struct{}
+	tokens             *tokenStore
+	trustedProxies     *iptree.Tree
+}
+
+type (
+	listenerContextKey     struct{}
+	connRequestsContextKey struct{}
+	clientAddrContextKey   struct{}
+)
+
+func (s *Server) newListener(lconf *listenerConfig) (*listener, error) {
+	l := &listener{
+		conf:      lconf,
+		paths:     make(map[string]struct{}, len(lconf.Paths)),
+		allow:     newNetworkTree(lconf.AllowClients),
+		deny:      newNetworkTree(lconf.DenyClients),
+		certs:     s.certs,
+		verbose:   s.conf.Verbose,
+		enableTLS: lconf.Cert != "" || len(s.conf.Certificates) != 0,
+
+		trustedProxies: newNetworkTree(s.conf.TrustedProxies),
+	}
+	if lconf.TLS != nil {
+		l.enableTLS = *lconf.TLS
+	}
+	if lconf.Verbose != nil {
+		l.verbose = *lconf.Verbose
+	}
+	if s.tokens != nil && (lconf.RequireToken == nil || *lconf.RequireToken) {
+		l.tokens = s.tokens
+	}
+	for _, path := range lconf.Paths {
+		l.paths[path] = struct{}{}
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.serveHTTP(s.servemux, w, r)
+	}))
+	if l.verbose {
+		handler = handlers.CombinedLoggingHandler(os.Stdout, handler)
+	}
+	if l.tokens != nil {
+		// Take the token out of the path before it could be logged
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, l.extractToken(r))
+		})
+	}
+	l.server = &http.Server{
+		Addr:              lconf.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(s.conf.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(s.conf.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(s.conf.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(s.conf.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    s.conf.MaxHeaderBytes,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: s.conf.HTTP2MaxConcurrentStreams,
+			MaxReadFrameSize:     s.conf.HTTP2MaxReadFrameSize,
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx = context.WithValue(ctx, listenerContextKey{}, l)
+			return context.WithValue(ctx, connRequestsContextKey{}, new(atomic.Int64))
+		},
+	}
+	l.maxRequestsPerConn = int64(s.conf.MaxRequestsPerConn)
+	l.connSem = s.connSem
+
+	if l.enableTLS {
+		if lconf.Cert != "" {
+			c, err := loadCertificate(&certificateConfig{Cert: lconf.Cert, Key: lconf.Key, OCSPStaple: lconf.OCSPStaple})
+			if err != nil {
+				return nil, err
+			}
+			l.ownCert = c
+		}
+		tlsConfig := s.tlsConfig.Clone()
+		tlsConfig.GetCertificate = l.getCertificate
+		if *lconf.TLSClientAuth {
+			clientCA, err := os.ReadFile(lconf.TLSClientAuthCA)
+			if err != nil {
+				return nil, fmt.Errorf("reading certificate for client authentication has failed: %w", err)
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			tlsConfig.ClientCAs.AppendCertsFromPEM(clientCA)
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			log.Printf("Certificate loaded for client TLS authentication on %s\n", lconf.Listen)
+			if lconf.TLSClientAuthCRL != "" {
+				crls, err := newCRLStore(lconf.TLSClientAuthCRL)
+				if err != nil {
+					return nil, fmt.Errorf("reading certificate revocation list has failed: %w", err)
+				}
+				tlsConfig.VerifyConnection = crls.verifyConnection
+			}
+		}
+		l.server.TLSConfig = tlsConfig
+		s.tlsConfigs = append(s.tlsConfigs, tlsConfig)
+	}
+	return l, nil
+}
+
+func (l *listener) serve() error {
+	ln, err := net.Listen("tcp", l.conf.Listen)
+	if err != nil {
+		return err
+	}
+	return l.serveListener(ln)
+}
+
+func (l *listener) serveListener(ln net.Listener) error {
+	if l.connSem != nil {
+		ln = &limitListener{Listener: ln, sem: l.connSem}
+	}
+	if l.enableTLS {
+		// ServeTLS would serve a clone of TLSConfig, out of reach of
+		// rotateSessionTicketKeys
+		ln = tls.NewListener(ln, l.server.TLSConfig)
+	}
+	return l.server.Serve(ln)
+}
+
+func (l *listener) serveHTTP(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if !l.allowPath(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if !l.allowClient(r.RemoteAddr) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), clientAddrContextKey{}, l.realClientAddr(r)))
+	// Browsers send CORS preflight requests without credentials, and they
+	// never reach upstream.
+	if l.tokens != nil && r.Method != http.MethodOptions {
+		token, ok := l.authenticate(w, r)
+		if !ok {
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), authTokenContextKey{}, token))
+	}
+	if l.maxRequestsPerConn > 0 {
+		if requests, ok := r.Context().Value(connRequestsContextKey{}).(*atomic.Int64); ok && requests.Add(1) >= l.maxRequestsPerConn {
+			// Both HTTP/1.1 and HTTP/2 close the connection gracefully
+			// after this response.
+			w.Header().Set("Connection", "close")
+		}
+	}
+	next.ServeHTTP(w, r)
+}
+
+type bearerTokenContextKey struct{}
+
+// extractToken moves a bearer token from the Authorization header or from
+// the last path segment (/dns-query/<token>) into the request context.
+func (l *listener) extractToken(r *http.Request) *http.Request {
+	var token string
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	} else if slash := strings.LastIndexByte(r.URL.Path, '/'); slash > 0 {
+		// Only strip the token if what remains is a path we serve, so that
+		// any other path still yields 404.
+		base := r.URL.Path[:slash]
+		if _, ok := l.paths[base]; ok || l.certs.hasPath(base) {
+			token = r.URL.Path[slash+1:]
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = base, ""
+			r.RequestURI = r.URL.RequestURI()
+		}
+	}
+	if token == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), bearerTokenContextKey{}, token))
+}
+
+// authenticate checks the bearer token of the request and its quota. On
+// failure it writes the error response.
+func (l *listener) authenticate(w http.ResponseWriter, r *http.Request) (*authToken, bool) {
+	plain, _ := r.Context().Value(bearerTokenContextKey{}).(string)
+	var token *authToken
+	if plain != "" {
+		token = l.tokens.lookup(plain)
+	}
+	if token == nil {
+		metricUnauthorized.Add(1)
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\"doh-server\"")
+		jsondns.FormatError(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !l.tokens.consume(token) {
+		metricQuotaExceededByToken.Add(token.label, 1)
+		jsondns.FormatError(w, "Query quota exceeded", http.StatusTooManyRequests)
+		return nil, false
+	}
+	metricQueriesByToken.Add(token.label, 1)
+	return token, true
+}
+
+// allowPath checks the request path against the paths served by the
+// listener, or against the path of the certificate selected by SNI if it has
+// one.
+func (l *listener) allowPath(r *http.Request) bool {
+	if r.TLS != nil {
+		if c := l.certs.lookup(r.TLS.ServerName); c != nil && c.conf.Path != "" {
+			return r.URL.Path == c.conf.Path
+		}
+	}
+	_, ok := l.paths[r.URL.Path]
+	return ok
+}
+
+func (l *listener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := l.certs.lookup(hello.ServerName); c != nil {
+		return c.get(), nil
+	}
+	if l.ownCert != nil {
+		return l.ownCert.get(), nil
+	}
+	if l.certs.defaultCert != nil {
+		return l.certs.defaultCert.get(), nil
+	}
+	return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+}
+
+// allowClient checks the address of the connecting peer against the
+// listener's access control lists. Deny rules take precedence.
+func (l *listener) allowClient(remoteAddr string) bool {
+	if l.allow == nil && l.deny == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if l.deny != nil {
+		if _, denied := l.deny.GetByIP(ip); denied {
+			return false
+		}
+	}
+	if l.allow != nil {
+		_, allowed := l.allow.GetByIP(ip)
+		return allowed
+	}
+	return true
+}
+
+// realClientAddr returns the address of the client: the connecting peer, or
+// the X-Real-IP header if the peer is one of the trusted reverse proxies.
+// Anyone else could put any address there.
+func (l *listener) realClientAddr(r *http.Request) net.IP {
+	peer := addrIP(r.RemoteAddr)
+	if peer == nil || l.trustedProxies == nil {
+		return peer
+	}
+	if _, ok := l.trustedProxies.GetByIP(peer); !ok {
+		return peer
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return peer
+}
+
+// clientAddr returns the client address to match client based policies
+// against, as found by realClientAddr, or nil. It does not trust the
+// RemoteAddr rewritten from X-Real-IP for logging.
+func clientAddr(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientAddrContextKey{}).(net.IP); ok {
+		return ip
+	}
+	return addrIP(r.RemoteAddr)
+}
+
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+func listenerFromContext(ctx context.Context) *listener {
+	l, _ := ctx.Value(listenerContextKey{}).(*listener)
+	return l
+}
+
+// isVerbose reports whether query logging is enabled for the listener that
+// accepted the request.
+func (s *Server) isVerbose(ctx context.Context) bool {
+	if l := listenerFromContext(ctx); l != nil {
+		return l.verbose
+	}
+	return s.conf.Verbose
+}
+
+func newNetworkTree(cidrs []string) *iptree.Tree {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	tree := iptree.NewTree()
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		tree.InplaceInsertNet(ipNet, struct{}{})
+	}
+	return tree
+}
+
+// limitListener caps the number of connections open at the same time. The
+// semaphore is shared by all listeners so that the cap is global.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	ln.sem <- struct{}{}
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		<-ln.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, sem: ln.sem}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	sem       chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { <-c.sem })
+	return err
+}
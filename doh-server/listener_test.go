@@ -0,0 +1,137 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestCertificate writes a new self-signed certificate for localhost and
+// its key to PEM files, and returns the certificate with the file names.
+func writeTestCertificate(t *testing.T) (cert tls.Certificate, certFile, keyFile string) {
+	cert = newTestCertificate(t)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestListenerAccess(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t, `
+upstream = ["udp:127.0.0.1:53"]
+
+[[listener]]
+listen = "127.0.0.1:0"
+paths = ["/dns-query"]
+allow_clients = ["10.0.0.0/8"]
+deny_clients = ["10.66.0.0/16"]
+`)
+	l, err := s.newListener(&s.conf.Listeners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range []struct {
+		peer, path string
+		want       int
+	}{
+		{"10.1.2.3:1234", "/dns-query", http.StatusOK},
+		// In both lists, deny_clients takes precedence
+		{"10.66.1.2:1234", "/dns-query", http.StatusForbidden},
+		{"192.0.2.1:1234", "/dns-query", http.StatusForbidden},
+		{"10.1.2.3:1234", "/resolve", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.RemoteAddr = tt.peer
+		w := httptest.NewRecorder()
+		l.serveHTTP(next, w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.peer, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestListenerCertificates(t *testing.T) {
+	t.Parallel()
+
+	cert1, certFile1, keyFile1 := writeTestCertificate(t)
+	cert2, certFile2, keyFile2 := writeTestCertificate(t)
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = ["udp:127.0.0.1:53"]
+
+[[listener]]
+listen = "127.0.0.1:0"
+cert = %q
+key = %q
+
+[[listener]]
+listen = "127.0.0.1:0"
+cert = %q
+key = %q
+`, certFile1, keyFile1, certFile2, keyFile2))
+
+	for i, want := range []tls.Certificate{cert1, cert2} {
+		l, err := s.newListener(&s.conf.Listeners[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go l.serveListener(ln)
+		t.Cleanup(func() { l.server.Close() })
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Raw
+		conn.Close()
+		if string(got) != string(want.Certificate[0]) {
+			t.Errorf("listener %d served the wrong certificate", i)
+		}
+	}
+}
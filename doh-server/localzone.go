@@ -0,0 +1,197 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// localZone holds the records of a zone loaded from a master file.
+type localZone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+}
+
+// localZones answers authoritatively from zone files, which are reloaded
+// when they change.
+type localZones struct {
+	paths []string
+	files []*watchedFile
+	mu    sync.RWMutex
+	zones []*localZone
+}
+
+func newLocalZones(paths []string) (*localZones, error) {
+	zones, err := loadZoneFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	lz := &localZones{
+		paths: paths,
+		zones: zones,
+	}
+	for _, path := range paths {
+		lz.files = append(lz.files, newWatchedFile(path))
+	}
+	return lz, nil
+}
+
+func loadZoneFiles(paths []string) ([]*localZone, error) {
+	zones := make([]*localZone, 0, len(paths))
+	for _, path := range paths {
+		zone, err := loadZoneFile(path)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// loadZoneFile reads an RFC 1035 master file. The owner of its SOA record is
+// the origin of the zone.
+func loadZoneFile(path string) (*localZone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zone := &localZone{
+		records: make(map[string][]dns.RR),
+	}
+	zp := dns.NewZoneParser(f, "", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+		if soa, isSOA := rr.(*dns.SOA); isSOA && zone.soa == nil {
+			zone.soa = soa
+			zone.origin = soa.Hdr.Name
+		}
+		zone.records[rr.Header().Name] = append(zone.records[rr.Header().Name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if zone.soa == nil {
+		return nil, fmt.Errorf("zone file %s has no SOA record", path)
+	}
+	for name := range zone.records {
+		if !dns.IsSubDomain(zone.origin, name) {
+			return nil, fmt.Errorf("zone file %s: %s is outside of zone %s", path, name, zone.origin)
+		}
+	}
+	return zone, nil
+}
+
+// answer returns an authoritative response if the question falls within one
+// of the zones, or nil.
+func (lz *localZones) answer(msg *dns.Msg) *dns.Msg {
+	if lz == nil || len(msg.Question) == 0 || msg.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	var changed bool
+	for _, f := range lz.files {
+		if f.changed() {
+			changed = true
+		}
+	}
+	if changed {
+		zones, err := loadZoneFiles(lz.paths)
+		if err != nil {
+			log.Printf("Error reloading local zones: %v\n", err)
+		} else {
+			lz.mu.Lock()
+			lz.zones = zones
+			lz.mu.Unlock()
+		}
+	}
+
+	question := msg.Question[0]
+	name := dns.CanonicalName(question.Name)
+	lz.mu.RLock()
+	defer lz.mu.RUnlock()
+
+	// The most specific zone wins.
+	var zone *localZone
+	for _, z := range lz.zones {
+		if dns.IsSubDomain(z.origin, name) && (zone == nil || dns.CountLabel(z.origin) > dns.CountLabel(zone.origin)) {
+			zone = z
+		}
+	}
+	if zone == nil {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.Authoritative = true
+	reply.RecursionAvailable = true
+
+	rrs, exists := zone.records[name]
+	var cname dns.RR
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case question.Qtype:
+			reply.Answer = append(reply.Answer, dns.Copy(rr))
+		case dns.TypeCNAME:
+			cname = rr
+			// Other records at the name would keep it out below.
+			if question.Qtype == dns.TypeANY {
+				reply.Answer = append(reply.Answer, dns.Copy(rr))
+			}
+		default:
+			if question.Qtype == dns.TypeANY {
+				reply.Answer = append(reply.Answer, dns.Copy(rr))
+			}
+		}
+	}
+	if len(reply.Answer) == 0 && cname != nil {
+		reply.Answer = append(reply.Answer, dns.Copy(cname))
+	}
+	if len(reply.Answer) != 0 {
+		return reply
+	}
+
+	if !exists {
+		// A name with records below it exists, even without records of its
+		// own.
+		for owner := range zone.records {
+			if dns.IsSubDomain(name, owner) {
+				exists = true
+				break
+			}
+		}
+	}
+	if !exists {
+		reply.Rcode = dns.RcodeNameError
+	}
+	reply.Ns = append(reply.Ns, dns.Copy(zone.soa))
+	return reply
+}
@@ -0,0 +1,129 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestZone writes a zone file with the given contents and returns its
+// path.
+func writeTestZone(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocalZonesAnswer(t *testing.T) {
+	t.Parallel()
+
+	corp := writeTestZone(t, "corp.zone", `$ORIGIN corp.example.
+$TTL 300
+@          IN SOA ns hostmaster 1 3600 600 86400 60
+@          IN NS  ns
+ns         IN A   10.0.0.53
+www        IN A   10.0.0.80
+www        IN TXT "intranet"
+intranet   IN CNAME www
+intranet   IN NSEC  ns.corp.example. CNAME RRSIG NSEC
+a.b.deep   IN A   10.0.0.99
+`)
+	lab := writeTestZone(t, "lab.zone", `$ORIGIN lab.corp.example.
+$TTL 300
+@          IN SOA ns.corp.example. hostmaster.corp.example. 1 3600 600 86400 60
+www        IN A   10.1.0.80
+`)
+	lz, err := newLocalZones([]string{corp, lab})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		return lz.answer(msg)
+	}
+
+	if reply := query("www.example.", dns.TypeA); reply != nil {
+		t.Errorf("answered outside the local zones:\n%v", reply)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []uint16
+		soa    string
+	}{
+		{"WWW.corp.example.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeA}, ""},
+		{"www.corp.example.", dns.TypeAAAA, dns.RcodeSuccess, nil, "corp.example."},
+		{"missing.corp.example.", dns.TypeA, dns.RcodeNameError, nil, "corp.example."},
+		// Empty non-terminals exist
+		{"deep.corp.example.", dns.TypeA, dns.RcodeSuccess, nil, "corp.example."},
+		{"b.deep.corp.example.", dns.TypeA, dns.RcodeSuccess, nil, "corp.example."},
+		{"intranet.corp.example.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME}, ""},
+		{"intranet.corp.example.", dns.TypeANY, dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeNSEC}, ""},
+		{"www.corp.example.", dns.TypeANY, dns.RcodeSuccess, []uint16{dns.TypeA, dns.TypeTXT}, ""},
+		// The most specific zone wins
+		{"www.lab.corp.example.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeA}, ""},
+		{"missing.lab.corp.example.", dns.TypeA, dns.RcodeNameError, nil, "lab.corp.example."},
+	} {
+		reply := query(tt.name, tt.qtype)
+		if reply == nil {
+			t.Errorf("%s %s: not answered", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		var answer []uint16
+		for _, rr := range reply.Answer {
+			answer = append(answer, rr.Header().Rrtype)
+		}
+		var soa string
+		if len(reply.Ns) == 1 {
+			if rr, ok := reply.Ns[0].(*dns.SOA); ok {
+				soa = rr.Hdr.Name
+			}
+		}
+		if reply.Rcode != tt.rcode || !reply.Authoritative || len(answer) != len(tt.answer) || soa != tt.soa {
+			t.Errorf("%s %s: got %s %v with SOA %q, want %s %v with SOA %q", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[reply.Rcode], answer, soa, dns.RcodeToString[tt.rcode], tt.answer, tt.soa)
+			continue
+		}
+		for i := range answer {
+			if answer[i] != tt.answer[i] {
+				t.Errorf("%s %s: answer types %v, want %v", tt.name, dns.TypeToString[tt.qtype], answer, tt.answer)
+				break
+			}
+		}
+	}
+
+	reply := query("www.corp.example.", dns.TypeA)
+	if a := reply.Answer[0].(*dns.A); a.A.String() != "10.0.0.80" {
+		t.Errorf("wrong address %s", a.A)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// Counters exported in JSON at /debug/vars on metrics_listen.
+var (
+	metricQueriesByToken       = expvar.NewMap("queries_by_token")
+	metricQuotaExceededByToken = expvar.NewMap("quota_exceeded_by_token")
+	metricUnauthorized         = expvar.NewInt("unauthorized_requests")
+
+	metricInflightQueries = expvar.NewInt("inflight_queries")
+	metricQueuedQueries   = expvar.NewInt("queued_queries")
+	metricShedQueries     = expvar.NewInt("shed_queries")
+
+	metricInvalidResponses = expvar.NewInt("invalid_upstream_responses")
+	metricScrubbedRecords  = expvar.NewInt("scrubbed_upstream_records")
+	metricDNS0x20Fallbacks = expvar.NewInt("dns0x20_tcp_fallbacks")
+	metricRcodeRetries     = expvar.NewInt("rcode_retries")
+	metricCoalescedQueries = expvar.NewInt("coalesced_queries")
+
+	metricCacheHits       = expvar.NewInt("cache_hits")
+	metricCacheMisses     = expvar.NewInt("cache_misses")
+	metricCachePrefetches = expvar.NewInt("cache_prefetches")
+	metricStaleAnswers    = expvar.NewInt("stale_answers")
+
+	metricMirrorQueries      = expvar.NewInt("mirror_queries")
+	metricMirrorDropped      = expvar.NewInt("mirror_dropped_queries")
+	metricMirrorErrors       = expvar.NewInt("mirror_errors")
+	metricMirrorRcodeDiffs   = expvar.NewInt("mirror_rcode_diffs")
+	metricMirrorAnswerDiffs  = expvar.NewInt("mirror_answer_diffs")
+	metricMirrorLatencyDiffs = expvar.NewInt("mirror_latency_diffs")
+)
+
+func (s *Server) serveMetrics() error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server := &http.Server{
+		Addr:              s.conf.MetricsListen,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(s.conf.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(s.conf.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(s.conf.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(s.conf.IdleTimeout) * time.Second,
+	}
+	return server.ListenAndServe()
+}
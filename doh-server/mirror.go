@@ -0,0 +1,215 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mirror sends a sample of the queries answered by upstream to a shadow
+// upstream and reports how its answers differ. Shadow answers are never
+// returned to clients.
+type mirror struct {
+	s                *Server
+	upstream         string
+	sampleRate       float64
+	latencyThreshold time.Duration
+	timeout          time.Duration
+	// Bounds the shadow queries in flight
+	sem chan struct{}
+}
+
+// mirrorDiff is logged as one JSON object per differing answer.
+type mirrorDiff struct {
+	Name            string   `json:"name"`
+	Type            string   `json:"type"`
+	Upstream        string   `json:"upstream"`
+	Shadow          string   `json:"shadow"`
+	Rcode           string   `json:"rcode"`
+	ShadowRcode     string   `json:"shadow_rcode"`
+	OnlyUpstream    []string `json:"only_upstream,omitempty"`
+	OnlyShadow      []string `json:"only_shadow,omitempty"`
+	LatencyMs       int64    `json:"latency_ms"`
+	ShadowLatencyMs int64    `json:"shadow_latency_ms"`
+	Error           string   `json:"error,omitempty"`
+}
+
+func newMirror(s *Server, conf *config) *mirror {
+	if conf.MirrorUpstream == "" {
+		return nil
+	}
+	return &mirror{
+		s:                s,
+		upstream:         conf.MirrorUpstream,
+		sampleRate:       conf.MirrorSampleRate,
+		latencyThreshold: time.Duration(conf.MirrorLatencyThreshold) * time.Millisecond,
+		timeout:          time.Duration(conf.Timeout) * time.Second,
+		sem:              make(chan struct{}, conf.MirrorMaxInflight),
+	}
+}
+
+// observe picks req for mirroring with the configured probability. resp is
+// the answer of req.currentUpstream, which took latency.
+func (m *mirror) observe(ctx context.Context, req *DNSRequest, resp *dns.Msg, latency time.Duration) {
+	if m == nil || len(req.request.Question) == 0 || rand.Float64() >= m.sampleRate {
+		return
+	}
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		metricMirrorDropped.Add(1)
+		return
+	}
+	query, _ := m.s.ecsPolicyFor(ctx, m.upstream).apply(req.request, req.clientIP)
+	// The response is rewritten in place after this, compare the original.
+	resp = resp.Copy()
+	upstream := req.currentUpstream
+	go func() {
+		defer func() { <-m.sem }()
+		m.compare(query, upstream, resp, latency)
+	}()
+}
+
+func (m *mirror) compare(query *dns.Msg, upstream string, resp *dns.Msg, latency time.Duration) {
+	metricMirrorQueries.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	shadowResp, err := m.exchange(ctx, query)
+	shadowLatency := time.Since(start)
+
+	question := &query.Question[0]
+	diff := &mirrorDiff{
+		Name:            question.Name,
+		Type:            dns.Type(question.Qtype).String(),
+		Upstream:        upstream,
+		Shadow:          m.upstream,
+		Rcode:           dns.RcodeToString[resp.Rcode],
+		LatencyMs:       latency.Milliseconds(),
+		ShadowLatencyMs: shadowLatency.Milliseconds(),
+	}
+	differs := false
+	if err != nil {
+		metricMirrorErrors.Add(1)
+		diff.Error = err.Error()
+		differs = true
+	} else {
+		diff.ShadowRcode = dns.RcodeToString[shadowResp.Rcode]
+		if resp.Rcode != shadowResp.Rcode {
+			metricMirrorRcodeDiffs.Add(1)
+			differs = true
+		}
+		diff.OnlyUpstream, diff.OnlyShadow = diffAnswers(resp.Answer, shadowResp.Answer)
+		if len(diff.OnlyUpstream) != 0 || len(diff.OnlyShadow) != 0 {
+			metricMirrorAnswerDiffs.Add(1)
+			differs = true
+		}
+		if delta := shadowLatency - latency; delta > m.latencyThreshold || -delta > m.latencyThreshold {
+			metricMirrorLatencyDiffs.Add(1)
+			differs = true
+		}
+	}
+	if !differs {
+		return
+	}
+	line, err := json.Marshal(diff)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("mirror diff: %s\n", line)
+}
+
+// exchange queries the shadow upstream like doDNSQuery queries the others,
+// without retries.
+func (m *mirror) exchange(ctx context.Context, query *dns.Msg) (resp *dns.Msg, err error) {
+	s := m.s
+	key := s.tsigKeys[m.upstream]
+	if key != nil {
+		key.sign(query)
+	}
+	address, t := addressAndType(m.upstream)
+	switch t {
+	case "tcp-tls":
+		resp, _, err = s.tcpClientTLS.ExchangeContext(ctx, query, address)
+	case "tcp":
+		resp, _, err = s.tcpClient.ExchangeContext(ctx, query, address)
+	default:
+		resp, _, err = s.udpClient.ExchangeContext(ctx, query, address)
+		if err == nil && resp.Truncated {
+			resp, _, err = s.tcpClient.ExchangeContext(ctx, query, address)
+		}
+	}
+	if err == nil {
+		err = validateResponse(query, resp, false)
+	}
+	if err == nil && key != nil {
+		err = checkSigned(resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	scrubResponse(resp)
+	return resp, nil
+}
+
+// diffAnswers compares two answer sections as sets of records, ignoring TTLs,
+// order and the case of owner names.
+func diffAnswers(a, b []dns.RR) (onlyA, onlyB []string) {
+	setA, setB := answerSet(a), answerSet(b)
+	for rr := range setA {
+		if _, ok := setB[rr]; !ok {
+			onlyA = append(onlyA, rr)
+		}
+	}
+	for rr := range setB {
+		if _, ok := setA[rr]; !ok {
+			onlyB = append(onlyB, rr)
+		}
+	}
+	slices.Sort(onlyA)
+	slices.Sort(onlyB)
+	return onlyA, onlyB
+}
+
+func answerSet(rrs []dns.RR) map[string]struct{} {
+	set := make(map[string]struct{}, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		hdr := rr.Header()
+		hdr.Name = strings.ToLower(hdr.Name)
+		hdr.Ttl = 0
+		set[rr.String()] = struct{}{}
+	}
+	return set
+}
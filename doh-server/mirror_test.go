@@ -0,0 +1,61 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDiffAnswers(t *testing.T) {
+	t.Parallel()
+
+	parse := func(records ...string) []dns.RR {
+		var rrs []dns.RR
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	a := parse("www.example. 300 IN A 192.0.2.1", "www.example. 300 IN A 192.0.2.2")
+	b := parse("WWW.Example. 60 IN A 192.0.2.2", "www.example. 60 IN A 192.0.2.3")
+	onlyA, onlyB := diffAnswers(a, b)
+	if !slices.Equal(onlyA, []string{"www.example.\t0\tIN\tA\t192.0.2.1"}) {
+		t.Errorf("only in a: %q", onlyA)
+	}
+	if !slices.Equal(onlyB, []string{"www.example.\t0\tIN\tA\t192.0.2.3"}) {
+		t.Errorf("only in b: %q", onlyB)
+	}
+
+	onlyA, onlyB = diffAnswers(a, parse("www.example. 1 IN A 192.0.2.2", "www.example. 1 IN A 192.0.2.1"))
+	if len(onlyA) != 0 || len(onlyB) != 0 {
+		t.Errorf("reordered answers differ: %q %q", onlyA, onlyB)
+	}
+}
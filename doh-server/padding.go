@@ -0,0 +1,88 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// Block length recommended for responses by RFC 8467 Section 4.1
+const paddingBlockSize = 468
+
+// padResponse replaces any padding from upstream with padding to a multiple
+// of paddingBlockSize, if the client padded its query, or if configured to
+// for all clients over TLS. Clients that did not use EDNS are never padded.
+func (s *Server) padResponse(r *http.Request, req *DNSRequest) {
+	opt := req.response.IsEdns0()
+	if opt != nil {
+		options := opt.Option[:0]
+		for _, option := range opt.Option {
+			if option.Option() != dns.EDNS0PADDING {
+				options = append(options, option)
+			}
+		}
+		opt.Option = options
+	}
+
+	if !req.clientEDNS || !(req.clientPadding || (s.conf.PadTLSResponses && r.TLS != nil)) {
+		return
+	}
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		req.response.Extra = append(req.response.Extra, opt)
+	}
+	padMessage(req.response, int(req.clientUDPSize))
+}
+
+// padMessage adds a Padding option (RFC 7830) to the OPT record of msg, so
+// that the packed message fills a whole number of blocks. A message that fits
+// within udpSize is not padded beyond it.
+func padMessage(msg *dns.Msg, udpSize int) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	// The option header takes 4 bytes.
+	size := len(packed) + 4
+	limit := dns.MaxMsgSize
+	if udpSize >= dns.MinMsgSize && len(packed) <= udpSize {
+		limit = udpSize
+	}
+	padded := (size + paddingBlockSize - 1) / paddingBlockSize * paddingBlockSize
+	if padded > limit {
+		if size > limit {
+			return
+		}
+		padded = limit
+	}
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, padded-size),
+	})
+}
@@ -0,0 +1,79 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadMessage(t *testing.T) {
+	t.Parallel()
+	newResponse := func(answers int) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Response = true
+		for i := 0; i < answers; i++ {
+			rr, err := dns.NewRR("example.com. 300 IN TXT \"0123456789012345678901234567890123456789\"")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Answer = append(msg.Answer, rr)
+		}
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 24,
+			SourceScope:   24,
+			Address:       []byte{192, 0, 2, 0},
+		})
+		return msg
+	}
+
+	for _, tc := range []struct {
+		answers int
+		udpSize int
+		want    int
+	}{
+		{0, 4096, 468},
+		{10, 4096, 936},
+		// Padding stops at the UDP size the response fits in
+		{7, 512, 512},
+		// Responses larger than the UDP size are padded as usual
+		{10, 600, 936},
+		{40, 1232, 2808},
+	} {
+		msg := newResponse(tc.answers)
+		padMessage(msg, tc.udpSize)
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed) != tc.want {
+			t.Errorf("%d answers, UDP size %d: padded to %d bytes, want %d", tc.answers, tc.udpSize, len(packed), tc.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// profile is a set of policies applied to the requests of an endpoint or of
+// a client identity.
+type profile struct {
+	name      string
+	conf      *profileConfig
+	limiter   *rateLimiter
+	blocklist *blocklist
+}
+
+func newProfile(name string, conf *profileConfig) (*profile, error) {
+	p := &profile{
+		name: name,
+		conf: conf,
+	}
+	if conf.RateLimit > 0 {
+		p.limiter = newRateLimiter(conf.RateLimit, conf.RateLimitBurst)
+	}
+	if conf.Blocklist != "" {
+		bl, err := newBlocklist(conf.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+		p.blocklist = bl
+	}
+	return p, nil
+}
+
+// selectProfile returns the profile configured for the client certificate
+// identity, or for the requested path, or nil.
+func (s *Server) selectProfile(r *http.Request) *profile {
+	if id := s.findClientIdentityConfig(clientIdentityFromRequest(r)); id != nil && id.Profile != "" {
+		return s.profiles[id.Profile]
+	}
+	if e, ok := s.endpoints[r.URL.Path]; ok && e.Profile != "" {
+		return s.profiles[e.Profile]
+	}
+	return nil
+}
+
+// allowRate checks the per-client rate limit of the profile, keyed on the
+// address found by the listener.
+func (p *profile) allowRate(r *http.Request) bool {
+	if p == nil || p.limiter == nil {
+		return true
+	}
+	return p.limiter.allow(clientAddr(r).String())
+}
+
+// blockedResponse returns an NXDOMAIN response if the question is on the
+// profile's blocklist, or nil.
+func (p *profile) blockedResponse(msg *dns.Msg) *dns.Msg {
+	if p == nil || p.blocklist == nil || len(msg.Question) == 0 {
+		return nil
+	}
+	if !p.blocklist.contains(msg.Question[0].Name) {
+		return nil
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeNameError)
+	reply.RecursionAvailable = true
+	return reply
+}
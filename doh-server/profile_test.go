@@ -0,0 +1,145 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+)
+
+// newProfileTestServer serves /family with a rate limited profile and
+// /resolve as a JSON endpoint, with an upstream answering 192.0.2.1.
+func newProfileTestServer(t *testing.T) *Server {
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		w.WriteMsg(resp)
+	})
+	return newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+
+[profile.family]
+rate_limit = 0.1
+rate_limit_burst = 1
+
+[[endpoint]]
+path = "/family"
+profile = "family"
+
+[[endpoint]]
+path = "/resolve"
+format = "json"
+`, upstream))
+}
+
+func TestSelectProfile(t *testing.T) {
+	t.Parallel()
+
+	s := newProfileTestServer(t)
+	for path, want := range map[string]string{
+		"/family":    "family",
+		"/dns-query": "",
+		"/resolve":   "",
+	} {
+		var got string
+		if p := s.selectProfile(httptest.NewRequest(http.MethodGet, path, nil)); p != nil {
+			got = p.name
+		}
+		if got != want {
+			t.Errorf("%s: profile %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	t.Parallel()
+
+	s := newProfileTestServer(t)
+	// Neither ct nor Accept says JSON, the endpoint does.
+	w := httptest.NewRecorder()
+	s.handlerFunc(w, httptest.NewRequest(http.MethodGet, "/resolve?name=www.example.&type=A", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=UTF-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var resp jsondns.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("not a JSON response: %v\n%s", err, w.Body.Bytes())
+	}
+	if resp.Status != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].Data != "192.0.2.1" {
+		t.Errorf("unexpected response: %s", w.Body.Bytes())
+	}
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	t.Parallel()
+
+	s := newProfileTestServer(t)
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	query.SetEdns0(dns.DefaultMsgSize, false)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.handlerFunc(w, httptest.NewRequest(http.MethodGet, "/family?dns="+base64.RawURLEncoding.EncodeToString(packed), nil))
+		return w
+	}
+
+	if w := wire(); w.Code != http.StatusOK {
+		t.Fatalf("first query: status %d", w.Code)
+	}
+	w := wire()
+	resp := new(dns.Msg)
+	if err := resp.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("rate limited wire-format query not answered in DNS: %v", err)
+	}
+	opt := resp.IsEdns0()
+	if resp.Rcode != dns.RcodeRefused || opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0EDE {
+		t.Errorf("unexpected response to a rate limited query:\n%v", resp)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "10" {
+		t.Errorf("Retry-After %q, want 10", ra)
+	}
+
+	w = httptest.NewRecorder()
+	s.handlerFunc(w, httptest.NewRequest(http.MethodGet, "/family?name=www.example.&type=A&ct=application/dns-json", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("JSON query: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,154 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/infobloxopen/go-trees/iptree"
+	"github.com/miekg/dns"
+)
+
+// TTL of the synthesized HINFO answer to ANY queries
+const anyHINFOTTL = 3600
+
+// qtypePolicy decides how queries are answered based on their type.
+type qtypePolicy struct {
+	anyPolicy          string
+	refuse             map[uint16]struct{}
+	nodata             map[uint16]struct{}
+	transferClients    *iptree.Tree
+	transferIdentities []string
+}
+
+func newQtypePolicy(conf *config) *qtypePolicy {
+	p := &qtypePolicy{
+		anyPolicy:          conf.AnyQueryPolicy,
+		refuse:             make(map[uint16]struct{}),
+		nodata:             make(map[uint16]struct{}),
+		transferClients:    newNetworkTree(conf.ZoneTransferAllowClients),
+		transferIdentities: conf.ZoneTransferAllowIdentities,
+	}
+	for _, t := range conf.RefuseQtypes {
+		p.refuse[dns.StringToType[t]] = struct{}{}
+	}
+	for _, t := range conf.NodataQtypes {
+		p.nodata[dns.StringToType[t]] = struct{}{}
+	}
+	return p
+}
+
+// answer returns a locally generated response if the policy does not let
+// the query go to upstream, or nil.
+func (p *qtypePolicy) answer(r *http.Request, msg *dns.Msg) *dns.Msg {
+	if len(msg.Question) == 0 {
+		return nil
+	}
+	qtype := msg.Question[0].Qtype
+
+	if _, ok := p.refuse[qtype]; ok {
+		return policyResponse(msg, dns.RcodeRefused)
+	}
+	if _, ok := p.nodata[qtype]; ok {
+		return policyResponse(msg, dns.RcodeSuccess)
+	}
+
+	switch qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		if !p.allowTransfer(r) {
+			return policyResponse(msg, dns.RcodeRefused)
+		}
+	case dns.TypeANY:
+		if p.anyPolicy == "hinfo" {
+			// RFC 8482 Section 4.2
+			reply := policyResponse(msg, dns.RcodeSuccess)
+			reply.Answer = append(reply.Answer, &dns.HINFO{
+				Hdr: dns.RR_Header{
+					Name:   msg.Question[0].Name,
+					Rrtype: dns.TypeHINFO,
+					Class:  msg.Question[0].Qclass,
+					Ttl:    anyHINFOTTL,
+				},
+				Cpu: "RFC8482",
+			})
+			return reply
+		}
+	}
+	return nil
+}
+
+// minimizeANY trims the answer to an ANY query down to its first RRset and
+// its signatures, as allowed by RFC 8482 Section 4.1.
+func (p *qtypePolicy) minimizeANY(req *DNSRequest) {
+	if p.anyPolicy != "minimal" || req.response == nil || len(req.request.Question) == 0 || req.request.Question[0].Qtype != dns.TypeANY {
+		return
+	}
+	var keep uint16
+	answer := req.response.Answer[:0]
+	for _, rr := range req.response.Answer {
+		rrtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		if rrtype == dns.TypeCNAME {
+			answer = append(answer, rr)
+			continue
+		}
+		if keep == 0 {
+			keep = rrtype
+		}
+		if rrtype == keep {
+			answer = append(answer, rr)
+		}
+	}
+	req.response.Answer = answer
+}
+
+// allowTransfer reports whether the client may request AXFR or IXFR, by its
+// address or its TLS client certificate identity. The address is the one
+// found by the listener, a client cannot choose it with X-Real-IP.
+func (p *qtypePolicy) allowTransfer(r *http.Request) bool {
+	if p.transferClients != nil {
+		if ip := clientAddr(r); ip != nil {
+			if _, ok := p.transferClients.GetByIP(ip); ok {
+				return true
+			}
+		}
+	}
+	if id := clientIdentityFromRequest(r); id != nil {
+		for _, pattern := range p.transferIdentities {
+			if id.matches(pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func policyResponse(msg *dns.Msg, rcode int) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, rcode)
+	reply.RecursionAvailable = true
+	return reply
+}
@@ -0,0 +1,61 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneTransferACL(t *testing.T) {
+	t.Parallel()
+
+	p := newQtypePolicy(&config{ZoneTransferAllowClients: []string{"10.0.0.0/8"}})
+	l := newTestListener()
+	axfr := new(dns.Msg)
+	axfr.SetQuestion("example.com.", dns.TypeAXFR)
+
+	for _, tt := range []struct {
+		peer  string
+		allow bool
+	}{
+		// X-Real-IP is 10.1.2.3, in the allowed network
+		{"198.51.100.7:1234", false},
+		{"127.0.0.1:1234", true},
+		{"10.9.9.9:1234", true},
+		{"[2001:db8::1]:1234", false},
+	} {
+		serveThroughListener(l, tt.peer, func(r *http.Request) {
+			if allow := p.allowTransfer(r); allow != tt.allow {
+				t.Errorf("peer %s: allowTransfer = %v, want %v", tt.peer, allow, tt.allow)
+			}
+			refused := p.answer(r, axfr) != nil
+			if refused == tt.allow {
+				t.Errorf("peer %s: transfer refused = %v", tt.peer, refused)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRateLimitRealIP(t *testing.T) {
+	t.Parallel()
+
+	p, err := newProfile("limited", &profileConfig{RateLimit: 0.001, RateLimitBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestListener()
+	for _, tt := range []struct {
+		peer  string
+		allow bool
+	}{
+		// X-Real-IP is always 10.1.2.3, only trusted from 127.0.0.1
+		{"198.51.100.7:1234", true},
+		{"198.51.100.8:1234", true},
+		{"198.51.100.7:5678", false},
+		{"127.0.0.1:1234", true},
+		{"127.0.0.2:1234", false},
+	} {
+		serveThroughListener(l, tt.peer, func(r *http.Request) {
+			if allow := p.allowRate(r); allow != tt.allow {
+				t.Errorf("peer %s: allowRate = %v, want %v", tt.peer, allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(0.001, 1)
+	for i := range maxRateLimitBuckets + 10 {
+		rl.allow(fmt.Sprint(i))
+	}
+	if len(rl.buckets) > maxRateLimitBuckets {
+		t.Errorf("%d buckets, want at most %d", len(rl.buckets), maxRateLimitBuckets)
+	}
+	if !rl.allow("new") {
+		t.Error("new client limited")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/m13253/dns-over-https/v2/selector"
+)
+
+// errRetryRcode is reported to the selector for answers with one of the
+// retry rcodes.
+var errRetryRcode = errors.New("upstream answered with a retry rcode")
+
+// retryPolicy decides which upstreams a query goes to and when an answer is
+// bad enough to try the next one.
+type retryPolicy struct {
+	tries    uint
+	rcodes   map[int]struct{}
+	fallback []string
+	// Zero unless timeout is an overall budget shared by the tries
+	budget time.Duration
+}
+
+func newRetryPolicy(conf *config) *retryPolicy {
+	p := &retryPolicy{
+		tries:    conf.Tries,
+		rcodes:   make(map[int]struct{}, len(conf.RetryRcodes)),
+		fallback: conf.UpstreamGroups[conf.FallbackUpstreamGroup],
+	}
+	for _, rcode := range conf.RetryRcodes {
+		p.rcodes[dns.StringToRcode[rcode]] = struct{}{}
+	}
+	if conf.SplitTimeout {
+		p.budget = time.Duration(conf.Timeout) * time.Second
+	}
+	return p
+}
+
+// numTries returns how many upstreams a query may be sent to.
+func (p *retryPolicy) numTries() int {
+	return int(p.tries) + len(p.fallback)
+}
+
+// pick returns the upstream for try i: a pick from sel for the first tries,
+// then the fallback group in its configured order. u is nil for fallback
+// upstreams, which are not picked by a selector.
+func (p *retryPolicy) pick(sel selector.Selector, i int, last string) (upstream string, u *selector.Upstream) {
+	if i >= int(p.tries) {
+		return p.fallback[i-int(p.tries)], nil
+	}
+	u = sel.Get()
+	// The selector may not have caught up with the failure of the last
+	// try yet, ask it again rather than repeat the same upstream.
+	for j := 0; j < 2 && u.URL == last; j++ {
+		u = sel.Get()
+	}
+	return u.URL, u
+}
+
+// retry reports whether resp should be replaced by an answer from another
+// upstream.
+func (p *retryPolicy) retry(resp *dns.Msg) bool {
+	_, ok := p.rcodes[resp.Rcode]
+	return ok
+}
+
+// withBudget bounds the whole query by the time budget, if there is one.
+func (p *retryPolicy) withBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.budget == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.budget)
+}
+
+// tryContext gives one try an even share of the time left in the budget, so
+// a slow upstream cannot use up the time of the ones after it.
+func (p *retryPolicy) tryContext(ctx context.Context, triesLeft int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if p.budget == 0 || !ok || triesLeft <= 1 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(triesLeft))
+}
@@ -0,0 +1,84 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m13253/dns-over-https/v2/selector"
+)
+
+func TestRetryPick(t *testing.T) {
+	t.Parallel()
+
+	p := &retryPolicy{tries: 4, fallback: []string{"udp:192.0.2.1:53", "udp:192.0.2.2:53"}}
+	sel := selector.NewRandomSelector()
+	for _, us := range []string{"udp:198.51.100.1:53", "udp:198.51.100.2:53"} {
+		if err := sel.Add(us, selector.DNS); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.numTries() != 6 {
+		t.Fatalf("got %d tries, want 6", p.numTries())
+	}
+	var plan []string
+	last := ""
+	for i := 0; i < p.numTries(); i++ {
+		upstream, u := p.pick(sel, i, last)
+		if (u != nil) != (i < 4) {
+			t.Errorf("try %d: picked by selector = %v", i, u != nil)
+		}
+		plan = append(plan, upstream)
+		last = upstream
+	}
+	if plan[4] != p.fallback[0] || plan[5] != p.fallback[1] {
+		t.Errorf("fallback out of order: %v", plan[4:])
+	}
+}
+
+func TestRetryTryContext(t *testing.T) {
+	t.Parallel()
+
+	p := &retryPolicy{budget: 4 * time.Second}
+	ctx, cancel := p.withBudget(context.Background())
+	defer cancel()
+	tryCtx, tryCancel := p.tryContext(ctx, 4)
+	defer tryCancel()
+	deadline, ok := tryCtx.Deadline()
+	if !ok {
+		t.Fatal("try has no deadline")
+	}
+	if left := time.Until(deadline); left > time.Second || left < 900*time.Millisecond {
+		t.Errorf("try got %v of the budget, want about 1s", left)
+	}
+
+	p = &retryPolicy{}
+	ctx, cancel = p.withBudget(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("deadline set without a budget")
+	}
+}
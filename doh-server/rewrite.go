@@ -0,0 +1,199 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/infobloxopen/go-trees/iptree"
+	"github.com/miekg/dns"
+)
+
+// rewriteRule shapes responses to the queries it matches.
+type rewriteRule struct {
+	names      []string
+	clients    *iptree.Tree
+	strip      map[uint16]struct{}
+	minTTL     uint32
+	maxTTL     uint32
+	minimal    bool
+	addressMap map[string]net.IP
+}
+
+func newRewriteRules(confs []rewriteConfig) []*rewriteRule {
+	rules := make([]*rewriteRule, 0, len(confs))
+	for _, conf := range confs {
+		rule := &rewriteRule{
+			clients:    newNetworkTree(conf.Clients),
+			strip:      make(map[uint16]struct{}),
+			minTTL:     conf.MinTTL,
+			maxTTL:     conf.MaxTTL,
+			minimal:    conf.Minimal,
+			addressMap: make(map[string]net.IP, len(conf.AddressMap)),
+		}
+		for _, name := range conf.Names {
+			rule.names = append(rule.names, dns.CanonicalName(name))
+		}
+		for _, t := range conf.StripTypes {
+			rule.strip[dns.StringToType[t]] = struct{}{}
+		}
+		for from, to := range conf.AddressMap {
+			rule.addressMap[net.ParseIP(from).String()] = net.ParseIP(to)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matches reports whether the rule applies to the query name and client
+// address. A rule without names or clients applies to all of them.
+func (rule *rewriteRule) matches(qname string, clientIP net.IP) bool {
+	if len(rule.names) != 0 {
+		var found bool
+		for _, name := range rule.names {
+			if dns.IsSubDomain(name, qname) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.clients != nil {
+		if clientIP == nil {
+			return false
+		}
+		if _, ok := rule.clients.GetByIP(clientIP); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply rewrites msg. Data the rule changes is no longer what the zone
+// signed, so the signatures over it are dropped and the AD bit is cleared.
+func (rule *rewriteRule) apply(msg *dns.Msg) {
+	if len(rule.strip) != 0 {
+		n := len(msg.Answer)
+		msg.Answer = rule.stripRecords(msg.Answer)
+		if len(msg.Answer) != n {
+			msg.AuthenticatedData = false
+		}
+	}
+	if len(rule.addressMap) != 0 {
+		mapped := make(map[rrsetKey]bool)
+		for _, rr := range msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if to, ok := rule.addressMap[rr.A.String()]; ok {
+					rr.A = to
+					mapped[rrsetKey{dns.CanonicalName(rr.Hdr.Name), dns.TypeA}] = true
+				}
+			case *dns.AAAA:
+				if to, ok := rule.addressMap[rr.AAAA.String()]; ok {
+					rr.AAAA = to
+					mapped[rrsetKey{dns.CanonicalName(rr.Hdr.Name), dns.TypeAAAA}] = true
+				}
+			}
+		}
+		if len(mapped) != 0 {
+			answer := msg.Answer[:0]
+			for _, rr := range msg.Answer {
+				if sig, ok := rr.(*dns.RRSIG); ok && mapped[rrsetKey{dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered}] {
+					continue
+				}
+				answer = append(answer, rr)
+			}
+			msg.Answer = answer
+			msg.AuthenticatedData = false
+		}
+	}
+	if rule.minimal {
+		// Negative answers keep the SOA record for caching, RFC 2308.
+		if len(msg.Answer) != 0 {
+			msg.Ns = nil
+		}
+		extra := msg.Extra[:0]
+		for _, rr := range msg.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		msg.Extra = extra
+	}
+	if rule.minTTL != 0 || rule.maxTTL != 0 {
+		for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+			for _, rr := range section {
+				hdr := rr.Header()
+				if hdr.Rrtype == dns.TypeOPT {
+					continue
+				}
+				if hdr.Ttl < rule.minTTL {
+					hdr.Ttl = rule.minTTL
+				}
+				if rule.maxTTL != 0 && hdr.Ttl > rule.maxTTL {
+					hdr.Ttl = rule.maxTTL
+				}
+			}
+		}
+	}
+}
+
+// rrsetKey identifies the records of one type at one owner name.
+type rrsetKey struct {
+	owner  string
+	rrtype uint16
+}
+
+// stripRecords removes records of the stripped types, and their signatures.
+func (rule *rewriteRule) stripRecords(rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		if _, ok := rule.strip[rrtype]; !ok {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// rewriteResponse applies every matching [[rewrite]] rule to the response,
+// in the order they are configured.
+func (s *Server) rewriteResponse(r *http.Request, req *DNSRequest) {
+	if len(s.rewrites) == 0 || req.response == nil || len(req.request.Question) == 0 {
+		return
+	}
+	clientIP := clientAddr(r)
+	qname := req.request.Question[0].Name
+	for _, rule := range s.rewrites {
+		if rule.matches(qname, clientIP) {
+			rule.apply(req.response)
+		}
+	}
+}
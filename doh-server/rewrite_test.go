@@ -0,0 +1,180 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestMsg builds a response to qname/qtype with the records in each
+// section given in zone file format.
+func newTestMsg(t *testing.T, qname string, qtype uint16, answer, ns, extra []string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(qname, qtype)
+	msg.Response = true
+	for _, section := range []struct {
+		rrs *[]dns.RR
+		rr  []string
+	}{{&msg.Answer, answer}, {&msg.Ns, ns}, {&msg.Extra, extra}} {
+		for _, s := range section.rr {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+	return msg
+}
+
+func TestRewriteStripTypes(t *testing.T) {
+	t.Parallel()
+
+	rule := newRewriteRules([]rewriteConfig{{StripTypes: []string{"AAAA"}}})[0]
+	msg := newTestMsg(t, "www.example.", dns.TypeAAAA, []string{
+		"www.example. 300 IN AAAA 2001:db8::1",
+		"www.example. 300 IN RRSIG AAAA 13 2 300 20300101000000 20200101000000 12345 example. AAAA",
+	}, nil, nil)
+	msg.AuthenticatedData = true
+	rule.apply(msg)
+	if len(msg.Answer) != 0 {
+		t.Errorf("records or signatures left: %v", msg.Answer)
+	}
+	if msg.AuthenticatedData {
+		t.Error("AD bit kept on a rewritten answer")
+	}
+
+	msg = newTestMsg(t, "www.example.", dns.TypeA, []string{"www.example. 300 IN A 192.0.2.1"}, nil, nil)
+	msg.AuthenticatedData = true
+	rule.apply(msg)
+	if len(msg.Answer) != 1 || !msg.AuthenticatedData {
+		t.Errorf("answer without stripped types changed: %v", msg)
+	}
+}
+
+func TestRewriteTTL(t *testing.T) {
+	t.Parallel()
+
+	rule := newRewriteRules([]rewriteConfig{{MinTTL: 60, MaxTTL: 3600}})[0]
+	msg := newTestMsg(t, "www.example.", dns.TypeA, []string{
+		"www.example. 5 IN A 192.0.2.1",
+		"www.example. 86400 IN A 192.0.2.2",
+		"www.example. 300 IN A 192.0.2.3",
+	}, nil, nil)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	rule.apply(msg)
+	for i, want := range []uint32{60, 3600, 300} {
+		if ttl := msg.Answer[i].Header().Ttl; ttl != want {
+			t.Errorf("record %d: TTL %d, want %d", i, ttl, want)
+		}
+	}
+	if opt := msg.IsEdns0(); opt.Hdr.Ttl != 0 {
+		t.Errorf("OPT TTL (extended flags) changed to %d", opt.Hdr.Ttl)
+	}
+}
+
+func TestRewriteMinimal(t *testing.T) {
+	t.Parallel()
+
+	rule := newRewriteRules([]rewriteConfig{{Minimal: true}})[0]
+	msg := newTestMsg(t, "www.example.", dns.TypeA,
+		[]string{"www.example. 300 IN A 192.0.2.1"},
+		[]string{"example. 300 IN NS ns.example."},
+		[]string{"ns.example. 300 IN A 192.0.2.53"})
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	rule.apply(msg)
+	if len(msg.Answer) != 1 || len(msg.Ns) != 0 || len(msg.Extra) != 1 || msg.IsEdns0() == nil {
+		t.Errorf("positive answer not minimized to answer and OPT:\n%v", msg)
+	}
+
+	msg = newTestMsg(t, "nx.example.", dns.TypeA, nil,
+		[]string{"example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300"},
+		[]string{"ns.example. 300 IN A 192.0.2.53"})
+	msg.Rcode = dns.RcodeNameError
+	rule.apply(msg)
+	if len(msg.Ns) != 1 || len(msg.Extra) != 0 {
+		t.Errorf("negative answer lost its SOA record:\n%v", msg)
+	}
+}
+
+func TestRewriteAddressMap(t *testing.T) {
+	t.Parallel()
+
+	rule := newRewriteRules([]rewriteConfig{{AddressMap: map[string]string{
+		"203.0.113.10": "10.0.0.10",
+		"2001:db8::10": "fd00::10",
+	}}})[0]
+	msg := newTestMsg(t, "intranet.example.", dns.TypeA, []string{
+		"intranet.example. 300 IN A 203.0.113.10",
+		"intranet.example. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example. AAAA",
+		"intranet.example. 300 IN AAAA 2001:db8::10",
+		"intranet.example. 300 IN TXT \"unchanged\"",
+		"intranet.example. 300 IN RRSIG TXT 13 2 300 20300101000000 20200101000000 12345 example. AAAA",
+	}, nil, nil)
+	msg.AuthenticatedData = true
+	rule.apply(msg)
+	if a := msg.Answer[0].(*dns.A).A; !a.Equal(net.ParseIP("10.0.0.10")) {
+		t.Errorf("A not mapped: %s", a)
+	}
+	if aaaa := msg.Answer[1].(*dns.AAAA).AAAA; !aaaa.Equal(net.ParseIP("fd00::10")) {
+		t.Errorf("AAAA not mapped: %s", aaaa)
+	}
+	if len(msg.Answer) != 4 || msg.Answer[3].(*dns.RRSIG).TypeCovered != dns.TypeTXT {
+		t.Errorf("signatures not dropped from the mapped records only:\n%v", msg.Answer)
+	}
+	if msg.AuthenticatedData {
+		t.Error("AD bit kept on a rewritten answer")
+	}
+}
+
+func TestRewriteMatches(t *testing.T) {
+	t.Parallel()
+
+	rule := newRewriteRules([]rewriteConfig{{
+		Names:   []string{"Example.COM"},
+		Clients: []string{"10.64.0.0/16"},
+	}})[0]
+	for _, tt := range []struct {
+		qname, client string
+		want          bool
+	}{
+		{"www.example.com.", "10.64.1.1", true},
+		{"example.com.", "10.64.1.1", true},
+		{"www.notexample.com.", "10.64.1.1", false},
+		{"www.example.com.", "10.65.1.1", false},
+		{"www.example.com.", "", false},
+	} {
+		if got := rule.matches(tt.qname, net.ParseIP(tt.client)); got != tt.want {
+			t.Errorf("matches(%s, %s) = %v, want %v", tt.qname, tt.client, got, tt.want)
+		}
+	}
+
+	all := newRewriteRules([]rewriteConfig{{}})[0]
+	if !all.matches("anything.", nil) {
+		t.Error("rule without names or clients does not match everything")
+	}
+}
@@ -0,0 +1,186 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/m13253/dns-over-https/v2/selector"
+)
+
+// newUpstreamSelectors builds one selector for the default upstreams, keyed
+// by "", and one for every upstream group.
+func newUpstreamSelectors(conf *config) (map[string]selector.Selector, error) {
+	selectors := make(map[string]selector.Selector, len(conf.UpstreamGroups)+1)
+	sel, err := newUpstreamSelector(conf, conf.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	selectors[""] = sel
+	for name, group := range conf.UpstreamGroups {
+		sel, err := newUpstreamSelector(conf, group)
+		if err != nil {
+			return nil, err
+		}
+		selectors[name] = sel
+	}
+	return selectors, nil
+}
+
+// newUpstreamSelector builds a selector of the configured algorithm over
+// upstreams, weighted by the weight in [upstream_options."..."].
+func newUpstreamSelector(conf *config, upstreams []string) (selector.Selector, error) {
+	timeout := time.Duration(conf.Timeout) * time.Second
+	weight := func(us string) int32 {
+		if opts := conf.UpstreamOptions[us]; opts != nil && opts.Weight != 0 {
+			return opts.Weight
+		}
+		return 1
+	}
+
+	var sel selector.Selector
+	var err error
+	switch conf.UpstreamSelector {
+	case "weighted_round_robin":
+		s := selector.NewNginxWRRSelector(timeout)
+		for _, us := range upstreams {
+			if err = s.Add(us, selector.DNS, weight(us)); err != nil {
+				break
+			}
+		}
+		sel = s
+	case "lvs_weighted_round_robin":
+		s := selector.NewLVSWRRSelector(timeout)
+		for _, us := range upstreams {
+			if err = s.Add(us, selector.DNS, weight(us)); err != nil {
+				break
+			}
+		}
+		sel = s
+	case "lowest_latency":
+		s := selector.NewLowestLatencySelector(timeout)
+		for _, us := range upstreams {
+			if err = s.Add(us, selector.DNS); err != nil {
+				break
+			}
+		}
+		sel = s
+	default:
+		s := selector.NewRandomSelector()
+		for _, us := range upstreams {
+			if err = s.Add(us, selector.DNS); err != nil {
+				break
+			}
+		}
+		sel = s
+	}
+	if err != nil {
+		return nil, &configError{fmt.Sprintf("Invalid upstream: %s", err.Error())}
+	}
+	return sel, nil
+}
+
+// reachableUpstreams returns, for every selector, the upstreams a query
+// through it may be sent to: those it picks from, then the fallback group.
+func reachableUpstreams(conf *config, selectors map[string]selector.Selector) map[selector.Selector][]string {
+	fallback := conf.UpstreamGroups[conf.FallbackUpstreamGroup]
+	reachable := make(map[selector.Selector][]string, len(selectors))
+	for name, sel := range selectors {
+		upstreams := conf.Upstream
+		if name != "" {
+			upstreams = conf.UpstreamGroups[name]
+		}
+		reachable[sel] = append(upstreams[:len(upstreams):len(upstreams)], fallback...)
+	}
+	return reachable
+}
+
+// startUpstreamSelectors starts the health checks of the selectors.
+func (s *Server) startUpstreamSelectors() {
+	for name, sel := range s.selectors {
+		if checker, ok := sel.(selector.DNSChecker); ok {
+			checker.SetDNSCheck(s.checkUpstream)
+		}
+		sel.StartEvaluate()
+		if reporter, ok := sel.(selector.DebugReporter); ok && s.conf.Verbose {
+			if name != "" {
+				log.Printf("Reporting weights of upstream group %q\n", name)
+			}
+			reporter.ReportWeights()
+		}
+	}
+}
+
+// checkUpstream is the health check of the selectors. It queries
+// www.example.com with the clients and TSIG key queryUpstream uses, so that
+// an upstream which only answers from local_addr or to signed queries is not
+// taken for dead.
+func (s *Server) checkUpstream(url string) (time.Duration, error) {
+	upstream, t := addressAndType(url)
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	key := s.tsigKeys[url]
+	if key != nil {
+		key.sign(query)
+	}
+	var client *dns.Client
+	switch t {
+	case "tcp-tls":
+		client = s.tcpClientTLS
+	case "tcp":
+		client = s.tcpClient
+	case "udp":
+		client = s.udpClient
+	default:
+		return 0, fmt.Errorf("invalid DNS type %q in upstream %q", t, url)
+	}
+	resp, rtt, err := client.Exchange(query, upstream)
+	if err == nil && key != nil {
+		err = checkSigned(resp)
+	}
+	return rtt, err
+}
+
+// reportUpstream feeds the outcome of one try back to the selector that picked
+// the upstream. Fallback upstreams are not picked by a selector.
+func reportUpstream(sel selector.Selector, u *selector.Upstream, rtt time.Duration, err error) {
+	if u == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		sel.ReportUpstreamStatus(u, selector.OK)
+		if reporter, ok := sel.(selector.LatencyReporter); ok {
+			reporter.ReportUpstreamLatency(u, rtt)
+		}
+	case isTimeout(err):
+		sel.ReportUpstreamStatus(u, selector.Timeout)
+	default:
+		sel.ReportUpstreamStatus(u, selector.Error)
+	}
+}
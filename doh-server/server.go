@@ -26,20 +26,19 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/miekg/dns"
 
 	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+	"github.com/m13253/dns-over-https/v2/selector"
 )
 
 type Server struct {
@@ -48,16 +47,46 @@ type Server struct {
 	tcpClient    *dns.Client
 	tcpClientTLS *dns.Client
 	servemux     *http.ServeMux
+	certs        *certStore
+	tlsConfig    *tls.Config
+	tlsConfigs   []*tls.Config
+	connSem      chan struct{}
+	tokens       *tokenStore
+	profiles     map[string]*profile
+	endpoints    map[string]*endpointConfig
+	limiter      *queryLimiter
+	qtypePolicy  *qtypePolicy
+	dns64        *dns64
+	geoip        *geoIPMapper
+	rewrites     []*rewriteRule
+	views        []*view
+	tsigKeys     map[string]*tsigKey
+	retryPolicy  *retryPolicy
+	mirror       *mirror
+	selectors    map[string]selector.Selector
+	reachable    map[selector.Selector][]string
+	coalescer    *coalescer
+	cache        *responseCache
 }
 
 type DNSRequest struct {
 	request         *dns.Msg
 	response        *dns.Msg
+	profile         *profile
+	upstreams       selector.Selector
+	clientIP        net.IP
 	currentUpstream string
 	errtext         string
 	errcode         int
 	transactionID   uint16
 	isTailored      bool
+	// Responses are specific to the view, anything keyed by the request
+	// must include it.
+	view *view
+	// EDNS state of the query as sent by the client
+	clientEDNS    bool
+	clientPadding bool
+	clientUDPSize uint16
 }
 
 func NewServer(conf *config) (*Server, error) {
@@ -77,7 +106,13 @@ func NewServer(conf *config) (*Server, error) {
 			Net:     "tcp-tls",
 			Timeout: timeout,
 		},
-		servemux: http.NewServeMux(),
+		servemux:    http.NewServeMux(),
+		qtypePolicy: newQtypePolicy(conf),
+		retryPolicy: newRetryPolicy(conf),
+		coalescer:   newCoalescer(),
+		cache:       newResponseCache(conf),
+		dns64:       newDNS64(conf),
+		rewrites:    newRewriteRules(conf.Rewrites),
 	}
 	if conf.LocalAddr != "" {
 		udpLocalAddr, err := net.ResolveUDPAddr("udp", conf.LocalAddr)
@@ -101,65 +136,131 @@ func NewServer(conf *config) (*Server, error) {
 			LocalAddr: tcpLocalAddr,
 		}
 	}
-	s.servemux.HandleFunc(conf.Path, s.handlerFunc)
+	if conf.MaxInflightQueries > 0 {
+		s.limiter = newQueryLimiter(conf.MaxInflightQueries, conf.QueryQueueSize, time.Duration(conf.QueryQueueTimeout)*time.Second)
+	}
+	if conf.MaxConnections > 0 {
+		s.connSem = make(chan struct{}, conf.MaxConnections)
+	}
+
+	selectors, err := newUpstreamSelectors(conf)
+	if err != nil {
+		return nil, err
+	}
+	s.selectors = selectors
+	s.reachable = reachableUpstreams(conf, selectors)
+	s.mirror = newMirror(s, conf)
+
+	tsigKeys, tsigSecrets, err := loadTSIGKeys(conf)
+	if err != nil {
+		return nil, err
+	}
+	s.tsigKeys = tsigKeys
+	if len(tsigSecrets) != 0 {
+		s.udpClient.TsigSecret = tsigSecrets
+		s.tcpClient.TsigSecret = tsigSecrets
+		s.tcpClientTLS.TsigSecret = tsigSecrets
+	}
+
+	for i := range conf.Views {
+		v, err := newView(&conf.Views[i])
+		if err != nil {
+			return nil, err
+		}
+		s.views = append(s.views, v)
+	}
+
+	if len(conf.ECSGeoIPDatabases) != 0 {
+		geoip, err := newGeoIPMapper(conf.ECSGeoIPDatabases, conf.ECSGeoIPSubnets)
+		if err != nil {
+			return nil, err
+		}
+		s.geoip = geoip
+	}
+
+	if conf.AuthTokenFile != "" {
+		tokens, err := newTokenStore(conf.AuthTokenFile, time.Duration(conf.AuthTokenQuotaPeriod)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens = tokens
+	}
+
+	certs, err := newCertStore(conf.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	s.certs = certs
+	s.tlsConfig, err = newBaseTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]struct{})
+	for _, l := range conf.Listeners {
+		for _, path := range l.Paths {
+			paths[path] = struct{}{}
+		}
+	}
+	for _, c := range conf.Certificates {
+		if c.Path != "" {
+			paths[c.Path] = struct{}{}
+		}
+	}
+	s.profiles = make(map[string]*profile, len(conf.Profiles))
+	for name, pconf := range conf.Profiles {
+		p, err := newProfile(name, pconf)
+		if err != nil {
+			return nil, err
+		}
+		s.profiles[name] = p
+	}
+	s.endpoints = make(map[string]*endpointConfig, len(conf.Endpoints))
+	for i := range conf.Endpoints {
+		s.endpoints[conf.Endpoints[i].Path] = &conf.Endpoints[i]
+		paths[conf.Endpoints[i].Path] = struct{}{}
+	}
+	for path := range paths {
+		s.servemux.HandleFunc(path, s.handlerFunc)
+	}
 	return s, nil
 }
 
 func (s *Server) Start() error {
-	servemux := http.Handler(s.servemux)
-	if s.conf.Verbose {
-		servemux = handlers.CombinedLoggingHandler(os.Stdout, servemux)
+	listeners := make([]*listener, 0, len(s.conf.Listeners))
+	for i := range s.conf.Listeners {
+		l, err := s.newListener(&s.conf.Listeners[i])
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
 	}
 
-	var clientCAPool *x509.CertPool
-	if s.conf.TLSClientAuth {
-		if s.conf.TLSClientAuthCA != "" {
-			clientCA, err := os.ReadFile(s.conf.TLSClientAuthCA)
+	s.startUpstreamSelectors()
+	if s.conf.TLSSessionTicketKeyFile != "" {
+		go s.rotateSessionTicketKeys()
+	}
+	if s.geoip != nil {
+		go s.geoip.watch()
+	}
+	if s.conf.MetricsListen != "" {
+		go func() {
+			err := s.serveMetrics()
 			if err != nil {
-				log.Fatalf("Reading certificate for client authentication has failed: %v", err)
-			}
-			clientCAPool = x509.NewCertPool()
-			clientCAPool.AppendCertsFromPEM(clientCA)
-			log.Println("Certificate loaded for client TLS authentication")
-		} else {
-			log.Fatalln("TLS client authentication requires both tls_client_auth and tls_client_auth_ca, exiting.")
-		}
-	}
-
-	results := make(chan error, len(s.conf.Listen))
-	for _, addr := range s.conf.Listen {
-		go func(addr string) {
-			var err error
-			if s.conf.Cert != "" || s.conf.Key != "" {
-				if clientCAPool != nil {
-					srvtls := &http.Server{
-						Handler: servemux,
-						Addr:    addr,
-						TLSConfig: &tls.Config{
-							ClientCAs:  clientCAPool,
-							ClientAuth: tls.RequireAndVerifyClientCert,
-							GetCertificate: func(info *tls.ClientHelloInfo) (certificate *tls.Certificate, e error) {
-								c, err := tls.LoadX509KeyPair(s.conf.Cert, s.conf.Key)
-								if err != nil {
-									fmt.Printf("Error loading server certificate key pair: %v\n", err)
-									return nil, err
-								}
-								return &c, nil
-							},
-						},
-					}
-					err = srvtls.ListenAndServeTLS("", "")
-				} else {
-					err = http.ListenAndServeTLS(addr, s.conf.Cert, s.conf.Key, servemux)
-				}
-			} else {
-				err = http.ListenAndServe(addr, servemux)
+				log.Println(err)
 			}
+		}()
+	}
+
+	results := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			err := l.serve()
 			if err != nil {
 				log.Println(err)
 			}
 			results <- err
-		}(addr)
+		}(l)
 	}
 	// wait for all handlers
 	for i := 0; i < cap(results); i++ {
@@ -187,7 +288,7 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS, POST")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Max-Age", "3600")
@@ -211,6 +312,9 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 	}
 
 	contentType := r.Header.Get("Content-Type")
+	if e, ok := s.endpoints[r.URL.Path]; ok && e.Format == "json" {
+		contentType = "application/dns-json"
+	}
 	if ct := r.FormValue("ct"); ct != "" {
 		contentType = ct
 	}
@@ -247,6 +351,11 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	profile := s.selectProfile(r)
+	ctx = context.WithValue(ctx, profileContextKey{}, profile)
+	view := s.selectView(r)
+	ctx = context.WithValue(ctx, viewContextKey{}, view)
+
 	var req *DNSRequest
 	if contentType == "application/dns-json" {
 		req = s.parseRequestGoogle(ctx, w, r)
@@ -262,18 +371,65 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if req.errcode != 0 {
+		// A query that could be read far enough to get its ID is answered
+		// in kind.
+		if req.request != nil && responseType == "application/dns-message" {
+			s.generateErrorResponseIETF(ctx, w, r, req, dns.RcodeFormatError, dns.ExtendedErrorCodeOther, req.errtext)
+			return
+		}
 		jsondns.FormatError(w, req.errtext, req.errcode)
 		return
 	}
+	if !profile.allowRate(r) {
+		s.rateLimited(ctx, w, r, req, responseType, profile)
+		return
+	}
 
 	req = s.patchRootRD(req)
-
-	err := s.doDNSQuery(ctx, req)
-	if err != nil {
-		jsondns.FormatError(w, fmt.Sprintf("DNS query failure (%s)", err.Error()), 503)
-		return
+	req.profile = profile
+	req.view = view
+	req.clientIP = s.ecsClientIP(ctx, r)
+	req.upstreams = s.selectUpstreams(r, profile, view)
+
+	if answer := s.qtypePolicy.answer(r, req.request); answer != nil {
+		req.response = answer
+	} else if answer := view.answer(req.request); answer != nil {
+		req.response = answer
+	} else if blocked := profile.blockedResponse(req.request); blocked != nil {
+		req.response = blocked
+	} else {
+		if isZoneTransfer(req.request) {
+			if s.limiter != nil {
+				if !s.limiter.acquire(ctx) {
+					s.shedRequest(ctx, w, r, req, responseType)
+					return
+				}
+				defer s.limiter.release()
+			}
+			if err := s.doZoneTransfer(ctx, w, req, responseType); err != nil {
+				s.queryFailed(ctx, w, r, req, responseType, err)
+			}
+			return
+		}
+		var err error
+		if s.dns64.appliesTo(r) {
+			err = s.doDNS64Query(ctx, req)
+		} else {
+			err = s.doDNSQuery(ctx, req)
+		}
+		if errors.Is(err, errOverloaded) {
+			s.shedRequest(ctx, w, r, req, responseType)
+			return
+		}
+		if err != nil {
+			s.queryFailed(ctx, w, r, req, responseType, err)
+			return
+		}
+		s.qtypePolicy.minimizeANY(req)
 	}
 
+	s.rewriteResponse(r, req)
+
 	if responseType == "application/json" {
 		s.generateResponseGoogle(ctx, w, r, req)
 	} else if responseType == "application/dns-message" {
@@ -283,6 +439,49 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// shedRequest answers a request that was rejected because too many upstream
+// queries are in flight. Wire-format clients get SERVFAIL with an Extended DNS
+// Error, as stub resolvers take HTTP errors as a broken endpoint.
+func (s *Server) shedRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, req *DNSRequest, responseType string) {
+	w.Header().Set("Retry-After", "1")
+	if responseType == "application/dns-message" {
+		s.generateErrorResponseIETF(ctx, w, r, req, dns.RcodeServerFailure, dns.ExtendedErrorCodeOther, "Server overloaded, try again later")
+		return
+	}
+	jsondns.FormatError(w, "Server overloaded, try again later", http.StatusServiceUnavailable)
+}
+
+// rateLimited answers a request over the rate limit of its profile.
+// Wire-format clients get REFUSED with an Extended DNS Error, like in
+// shedRequest.
+func (s *Server) rateLimited(ctx context.Context, w http.ResponseWriter, r *http.Request, req *DNSRequest, responseType string, p *profile) {
+	w.Header().Set("Retry-After", strconv.Itoa(p.limiter.retryAfter()))
+	if responseType == "application/dns-message" {
+		s.generateErrorResponseIETF(ctx, w, r, req, dns.RcodeRefused, dns.ExtendedErrorCodeOther, "Rate limit exceeded")
+		return
+	}
+	jsondns.FormatError(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// queryFailed answers a request that upstream could not resolve. Wire-format
+// clients get SERVFAIL with an Extended DNS Error instead of an HTTP error.
+func (s *Server) queryFailed(ctx context.Context, w http.ResponseWriter, r *http.Request, req *DNSRequest, responseType string, err error) {
+	if responseType == "application/dns-message" {
+		if isTimeout(err) {
+			s.generateErrorResponseIETF(ctx, w, r, req, dns.RcodeServerFailure, dns.ExtendedErrorCodeNoReachableAuthority, "Upstream timed out")
+		} else {
+			s.generateErrorResponseIETF(ctx, w, r, req, dns.RcodeServerFailure, dns.ExtendedErrorCodeNetworkError, "Upstream query failed")
+		}
+		return
+	}
+	jsondns.FormatError(w, fmt.Sprintf("DNS query failure (%s)", err.Error()), 503)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
 func (s *Server) findClientIP(r *http.Request) net.IP {
 	noEcs := r.URL.Query().Get("no_ecs")
 	if strings.EqualFold(noEcs, "true") {
@@ -319,6 +518,47 @@ func (s *Server) findClientIP(r *http.Request) net.IP {
 	return nil
 }
 
+// selectUpstreams returns the upstream group configured for the client
+// certificate identity, or for the view, or for the profile, or for the server
+// certificate the client connected with, or the default upstreams.
+func (s *Server) selectUpstreams(r *http.Request, p *profile, v *view) selector.Selector {
+	if id := s.findClientIdentityConfig(clientIdentityFromRequest(r)); id != nil && id.UpstreamGroup != "" {
+		return s.selectors[id.UpstreamGroup]
+	}
+	if v != nil && v.conf.UpstreamGroup != "" {
+		return s.selectors[v.conf.UpstreamGroup]
+	}
+	if p != nil && p.conf.UpstreamGroup != "" {
+		return s.selectors[p.conf.UpstreamGroup]
+	}
+	if r.TLS != nil {
+		if c := s.certs.lookup(r.TLS.ServerName); c != nil && c.conf.UpstreamGroup != "" {
+			return s.selectors[c.conf.UpstreamGroup]
+		}
+	}
+	return s.selectors[""]
+}
+
+type profileContextKey struct{}
+
+// ecsClientIP returns the client address to send as EDNS Client Subnet, or
+// nil if the profile of the request disables it.
+func (s *Server) ecsClientIP(ctx context.Context, r *http.Request) net.IP {
+	if p, _ := ctx.Value(profileContextKey{}).(*profile); p != nil && p.conf.NoECS {
+		return nil
+	}
+	return s.findClientIP(r)
+}
+
+// use0x20 reports whether query names sent to the upstream get their case
+// randomized.
+func (s *Server) use0x20(upstream string) bool {
+	if opts := s.conf.UpstreamOptions[upstream]; opts != nil && opts.DNS0x20 != nil {
+		return *opts.DNS0x20
+	}
+	return s.conf.DNS0x20
+}
+
 // Workaround a bug causing Unbound to refuse returning anything about the root.
 func (s *Server) patchRootRD(req *DNSRequest) *DNSRequest {
 	for _, question := range req.request.Question {
@@ -329,54 +569,108 @@ func (s *Server) patchRootRD(req *DNSRequest) *DNSRequest {
 	return req
 }
 
-// Return the position index for the question of qtype from a DNS msg, otherwise return -1.
-func (s *Server) indexQuestionType(msg *dns.Msg, qtype uint16) int {
-	for i, question := range msg.Question {
-		if question.Qtype == qtype {
-			return i
-		}
+// queryUpstream sends req to upstream, trying other upstreams as configured
+// until one answers.
+func (s *Server) queryUpstream(ctx context.Context, req *DNSRequest) (err error) {
+	sel := req.upstreams
+	if sel == nil {
+		sel = s.selectors[""]
 	}
-	return -1
-}
-
-func (s *Server) doDNSQuery(ctx context.Context, req *DNSRequest) (err error) {
-	numServers := len(s.conf.Upstream)
-	for i := uint(0); i < s.conf.Tries; i++ {
-		req.currentUpstream = s.conf.Upstream[rand.Intn(numServers)]
+	ctx, cancel := s.retryPolicy.withBudget(ctx)
+	defer cancel()
+	// Answer with the last upstream response rather than an error if every
+	// try is rejected by rcode.
+	var lastResponse *dns.Msg
+	var lastUpstream string
+	numTries := s.retryPolicy.numTries()
+	for i := 0; i < numTries; i++ {
+		var picked *selector.Upstream
+		req.currentUpstream, picked = s.retryPolicy.pick(sel, i, req.currentUpstream)
 
 		upstream, t := addressAndType(req.currentUpstream)
+		query, isTailored := s.ecsPolicyFor(ctx, req.currentUpstream).apply(req.request, req.clientIP)
+		var restoreName string
+		key := s.tsigKeys[req.currentUpstream]
+		if key != nil {
+			key.sign(query)
+		}
 
+		ctx, cancel := s.retryPolicy.tryContext(ctx, numTries-i)
+		start := time.Now()
 		switch t {
 		default:
+			cancel()
 			log.Printf("invalid DNS type %q in upstream %q", t, upstream)
 			return &configError{"invalid DNS type"}
 		// Use DNS-over-TLS (DoT) if configured to do so
 		case "tcp-tls":
-			req.response, _, err = s.tcpClientTLS.ExchangeContext(ctx, req.request, upstream)
+			req.response, _, err = s.tcpClientTLS.ExchangeContext(ctx, query, upstream)
 		case "tcp", "udp":
-			// Use TCP if always configured to or if the Query type dictates it (AXFR)
-			if t == "tcp" || (s.indexQuestionType(req.request, dns.TypeAXFR) > -1) {
-				req.response, _, err = s.tcpClient.ExchangeContext(ctx, req.request, upstream)
+			// Use TCP if always configured to
+			if t == "tcp" {
+				req.response, _, err = s.tcpClient.ExchangeContext(ctx, query, upstream)
 			} else {
-				req.response, _, err = s.udpClient.ExchangeContext(ctx, req.request, upstream)
+				use0x20 := s.use0x20(req.currentUpstream) && len(query.Question) != 0
+				if use0x20 {
+					restoreName = randomizeCase(query)
+				}
+				req.response, _, err = s.udpClient.ExchangeContext(ctx, query, upstream)
 				if err == nil && req.response != nil && req.response.Truncated {
 					log.Println(err)
-					req.response, _, err = s.tcpClient.ExchangeContext(ctx, req.request, upstream)
-				}
-
-				// Retry with TCP if this was an IXFR request, and we only received an SOA
-				if (s.indexQuestionType(req.request, dns.TypeIXFR) > -1) &&
-					(len(req.response.Answer) == 1) &&
-					(req.response.Answer[0].Header().Rrtype == dns.TypeSOA) {
-					req.response, _, err = s.tcpClient.ExchangeContext(ctx, req.request, upstream)
+					req.response, _, err = s.tcpClient.ExchangeContext(ctx, query, upstream)
+				} else if err == nil && use0x20 && validateResponse(query, req.response, true) == errCaseMismatch {
+					// Either the upstream does not preserve case or the
+					// response is spoofed. TCP is safe from off-path
+					// spoofing either way.
+					if s.isVerbose(ctx) {
+						log.Printf("Upstream %s did not preserve case, retrying with TCP\n", req.currentUpstream)
+					}
+					metricDNS0x20Fallbacks.Add(1)
+					req.response, _, err = s.tcpClient.ExchangeContext(ctx, query, upstream)
 				}
 			}
 		}
+		cancel()
 
 		if err == nil {
-			return nil
+			err = validateResponse(query, req.response, false)
+			if err == nil && key != nil {
+				err = checkSigned(req.response)
+			}
+			if err != nil {
+				metricInvalidResponses.Add(1)
+			}
 		}
+		if err == nil {
+			if restoreName != "" {
+				restoreCase(req.response, restoreName)
+			}
+			if removed := scrubResponse(req.response); removed != 0 {
+				metricScrubbedRecords.Add(int64(removed))
+				if s.isVerbose(ctx) {
+					log.Printf("Removed %d out-of-bailiwick records from upstream %s\n", removed, req.currentUpstream)
+				}
+			}
+			req.isTailored = isTailored
+			if !s.retryPolicy.retry(req.response) {
+				reportUpstream(sel, picked, time.Since(start), nil)
+				s.mirror.observe(ctx, req, req.response, time.Since(start))
+				return nil
+			}
+			reportUpstream(sel, picked, 0, errRetryRcode)
+			if s.isVerbose(ctx) {
+				log.Printf("Upstream %s answered %s, trying another upstream\n", req.currentUpstream, dns.RcodeToString[req.response.Rcode])
+			}
+			metricRcodeRetries.Add(1)
+			lastResponse, lastUpstream = req.response, req.currentUpstream
+			continue
+		}
+		reportUpstream(sel, picked, 0, err)
 		log.Printf("DNS error from upstream %s: %s\n", req.currentUpstream, err.Error())
 	}
+	if lastResponse != nil {
+		req.response, req.currentUpstream = lastResponse, lastUpstream
+		return nil
+	}
 	return err
 }
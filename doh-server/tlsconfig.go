@@ -0,0 +1,178 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// newBaseTLSConfig builds the TLS settings shared by every TLS listener.
+func newBaseTLSConfig(conf *config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Listeners are served without ServeTLS, which would add these
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if conf.TLSMinVersion != "" {
+		version, ok := tlsVersions[conf.TLSMinVersion]
+		if !ok {
+			return nil, &configError{fmt.Sprintf("Invalid tls_min_version %q, choose one of: 1.0 1.1 1.2 1.3", conf.TLSMinVersion)}
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(conf.TLSCipherSuites) != 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range conf.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, &configError{fmt.Sprintf("Unknown or insecure TLS cipher suite %q", name)}
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	for _, name := range conf.TLSCurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, &configError{fmt.Sprintf("Unknown TLS curve %q", name)}
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	if conf.TLSSessionTicketKeyFile != "" {
+		keys, err := loadSessionTicketKeys(conf.TLSSessionTicketKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+	return tlsConfig, nil
+}
+
+// loadSessionTicketKeys reads a file of concatenated 32-byte keys. The first
+// key encrypts new tickets, the others are kept to decrypt older ones.
+func loadSessionTicketKeys(path string) ([][32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%32 != 0 {
+		return nil, fmt.Errorf("session ticket key file %s must contain one or more 32-byte keys", path)
+	}
+	keys := make([][32]byte, len(data)/32)
+	for i := range keys {
+		copy(keys[i][:], data[i*32:])
+	}
+	return keys, nil
+}
+
+// rotateSessionTicketKeys reloads the session ticket keys into every TLS
+// listener whenever the key file changes.
+func (s *Server) rotateSessionTicketKeys() {
+	keyFile := newWatchedFile(s.conf.TLSSessionTicketKeyFile)
+	for {
+		time.Sleep(fileCheckInterval)
+		if !keyFile.changed() {
+			continue
+		}
+		if err := s.reloadSessionTicketKeys(); err != nil {
+			log.Printf("Error reloading session ticket keys: %v\n", err)
+			continue
+		}
+		log.Println("Session ticket keys rotated")
+	}
+}
+
+func (s *Server) reloadSessionTicketKeys() error {
+	keys, err := loadSessionTicketKeys(s.conf.TLSSessionTicketKeyFile)
+	if err != nil {
+		return err
+	}
+	for _, tlsConfig := range s.tlsConfigs {
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+	return nil
+}
+
+// loadOCSPStaple reads a DER-encoded OCSP response for cert and checks that
+// it is still good to be stapled. It returns the time the response expires.
+func loadOCSPStaple(path string, cert *tls.Certificate) ([]byte, time.Time, error) {
+	der, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		issuer, err = x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, time.Time{}, fmt.Errorf("certificate status is not good")
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return nil, time.Time{}, fmt.Errorf("response expired at %s", resp.NextUpdate)
+	}
+	return der, resp.NextUpdate, nil
+}
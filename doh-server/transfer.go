@@ -0,0 +1,239 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+	"github.com/m13253/dns-over-https/v2/selector"
+	"github.com/miekg/dns"
+)
+
+// isZoneTransfer reports whether the request asks for AXFR or IXFR.
+func isZoneTransfer(msg *dns.Msg) bool {
+	if len(msg.Question) == 0 {
+		return false
+	}
+	qtype := msg.Question[0].Qtype
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// doZoneTransfer runs a zone transfer with upstream and streams every message
+// to the client as it arrives. Wire-format clients get the messages prefixed
+// with their 2-byte length, as on a DNS TCP connection. JSON clients get an
+// array of responses, which is only sent once the transfer has completed, as
+// a cut-off array would look like a whole one.
+//
+// An error is returned only if nothing has been written to the client yet.
+// If a wire-format transfer fails after that, the stream is cut short and
+// lacks the closing SOA record.
+func (s *Server) doZoneTransfer(ctx context.Context, w http.ResponseWriter, req *DNSRequest, responseType string) (err error) {
+	sel := req.upstreams
+	if sel == nil {
+		sel = s.selectors[""]
+	}
+	numTries := s.retryPolicy.numTries()
+	for i := 0; i < numTries; i++ {
+		var picked *selector.Upstream
+		req.currentUpstream, picked = s.retryPolicy.pick(sel, i, req.currentUpstream)
+		var started bool
+		started, err = s.transferFrom(ctx, w, req, responseType)
+		if err == nil {
+			// A transfer takes as long as the zone is large, it says
+			// nothing about the upstream's latency.
+			if picked != nil {
+				sel.ReportUpstreamStatus(picked, selector.OK)
+			}
+			return nil
+		}
+		log.Printf("Zone transfer error from upstream %s: %s\n", req.currentUpstream, err.Error())
+		reportUpstream(sel, picked, 0, err)
+		if started {
+			return nil
+		}
+	}
+	return err
+}
+
+// transferFrom runs one zone transfer attempt and reports whether anything
+// was written to the client.
+func (s *Server) transferFrom(ctx context.Context, w http.ResponseWriter, req *DNSRequest, responseType string) (started bool, err error) {
+	upstream, t := addressAndType(req.currentUpstream)
+	conn, err := s.dialTransfer(ctx, upstream, t)
+	if err != nil {
+		return false, err
+	}
+	timeout := time.Duration(s.conf.Timeout) * time.Second
+	transfer := &dns.Transfer{
+		Conn:         conn,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+	query := req.request.Copy()
+	if key := s.tsigKeys[req.currentUpstream]; key != nil {
+		// The upstream's own key takes precedence.
+		transfer.TsigSecret = map[string]string{key.name: key.secret}
+		key.sign(query)
+	} else if s.conf.ZoneTransferTSIGKey != "" {
+		transfer.TsigSecret = map[string]string{s.conf.ZoneTransferTSIGKey: s.conf.ZoneTransferTSIGSecret}
+		query.SetTsig(s.conf.ZoneTransferTSIGKey, s.conf.ZoneTransferTSIGAlgorithm, tsigFudge, time.Now().Unix())
+	}
+	envelopes, err := transfer.In(query, upstream)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	defer func() {
+		// Unblock the reading goroutine if we stop early.
+		conn.Close()
+		for range envelopes {
+		}
+	}()
+
+	var out io.Writer = w
+	var jsonBuf *bytes.Buffer
+	if responseType == "application/json" {
+		jsonBuf = new(bytes.Buffer)
+		out = jsonBuf
+	}
+	rc := http.NewResponseController(w)
+	first := true
+	for {
+		var env *dns.Envelope
+		var ok bool
+		select {
+		case env, ok = <-envelopes:
+		case <-ctx.Done():
+			return started, ctx.Err()
+		}
+		if !ok {
+			break
+		}
+		if env.Error != nil {
+			return started, env.Error
+		}
+
+		msg := new(dns.Msg)
+		msg.SetReply(req.request)
+		msg.Id = req.transactionID
+		msg.Answer = env.RR
+		if jsonBuf != nil {
+			if err := writeTransferMessage(out, msg, responseType, first); err != nil {
+				return false, err
+			}
+			first = false
+			continue
+		}
+		if first {
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/dns-message")
+		}
+		// The listener's write timeout is meant for single answers, give
+		// every message of the transfer its own.
+		rc.SetWriteDeadline(time.Now().Add(timeout))
+		if err := writeTransferMessage(out, msg, responseType, first); err != nil {
+			return true, err
+		}
+		first = false
+		started = true
+		rc.Flush()
+	}
+
+	if first {
+		return false, errors.New("empty zone transfer")
+	}
+	if jsonBuf != nil {
+		jsonBuf.WriteString("]")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		rc.SetWriteDeadline(time.Now().Add(timeout))
+		w.Write(jsonBuf.Bytes())
+	}
+	return true, nil
+}
+
+func (s *Server) dialTransfer(ctx context.Context, upstream, t string) (*dns.Conn, error) {
+	dialer := s.tcpClient.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: time.Duration(s.conf.Timeout) * time.Second}
+	}
+	switch t {
+	case "tcp", "udp":
+		conn, err := dialer.DialContext(ctx, "tcp", upstream)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: conn}, nil
+	case "tcp-tls":
+		tlsDialer := &tls.Dialer{NetDialer: dialer}
+		conn, err := tlsDialer.DialContext(ctx, "tcp", upstream)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: conn}, nil
+	default:
+		return nil, &configError{fmt.Sprintf("invalid DNS type %q in upstream %q", t, upstream)}
+	}
+}
+
+func writeTransferMessage(w io.Writer, msg *dns.Msg, responseType string, first bool) error {
+	if responseType == "application/json" {
+		respStr, err := json.Marshal(jsondns.Marshal(msg))
+		if err != nil {
+			return err
+		}
+		if first {
+			respStr = append([]byte("["), respStr...)
+		} else {
+			respStr = append([]byte(","), respStr...)
+		}
+		_, err = w.Write(respStr)
+		return err
+	}
+
+	respBytes, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if len(respBytes) > 0xffff {
+		return fmt.Errorf("zone transfer message too large (%d bytes)", len(respBytes))
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(respBytes))))
+	if err == nil {
+		_, err = w.Write(respBytes)
+	}
+	return err
+}
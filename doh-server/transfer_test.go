@@ -0,0 +1,174 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	jsondns "github.com/m13253/dns-over-https/v2/json-dns"
+)
+
+// startTestTransferUpstream serves a zone transfer of example. in three
+// messages on a TCP port of the loopback interface, and returns its address as
+// written in upstream lists.
+func startTestTransferUpstream(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa, _ := dns.NewRR("example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300")
+	a, _ := dns.NewRR("www.example. 300 IN A 192.0.2.1")
+	server := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ch := make(chan *dns.Envelope)
+		tr := new(dns.Transfer)
+		go func() {
+			for _, rrs := range [][]dns.RR{{soa}, {a}, {soa}} {
+				ch <- &dns.Envelope{RR: rrs}
+			}
+			close(ch)
+		}()
+		tr.Out(w, r, ch)
+		w.Close()
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return "tcp:" + ln.Addr().String()
+}
+
+func TestZoneTransferOutput(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t, fmt.Sprintf("upstream = [%q]\n", startTestTransferUpstream(t)))
+	request := func() *DNSRequest {
+		msg := new(dns.Msg)
+		msg.SetAxfr("example.")
+		return &DNSRequest{request: msg, transactionID: 4242}
+	}
+
+	w := httptest.NewRecorder()
+	if err := s.doZoneTransfer(context.Background(), w, request(), "application/dns-message"); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*dns.Msg
+	for body := w.Body.Bytes(); len(body) != 0; {
+		if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+			t.Fatalf("truncated message after %d messages", len(msgs))
+		}
+		n := 2 + int(binary.BigEndian.Uint16(body))
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body[2:n]); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+		body = body[n:]
+	}
+	if len(msgs) != 3 || msgs[0].Id != 4242 || msgs[1].Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("unexpected wire-format output: %v", msgs)
+	}
+
+	w = httptest.NewRecorder()
+	if err := s.doZoneTransfer(context.Background(), w, request(), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	var responses []jsondns.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("output is not a JSON array: %v\n%s", err, w.Body.Bytes())
+	}
+	if len(responses) != 3 || len(responses[1].Answer) != 1 || responses[1].Answer[0].Name != "www.example." {
+		t.Errorf("unexpected JSON output: %s", w.Body.Bytes())
+	}
+}
+
+// startTestBrokenTransferUpstream sends the first message of a zone transfer
+// and then closes the connection.
+func startTestBrokenTransferUpstream(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa, _ := dns.NewRR("example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300")
+	server := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Answer = []dns.RR{soa}
+		w.WriteMsg(msg)
+		w.Close()
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return "tcp:" + ln.Addr().String()
+}
+
+func TestZoneTransferFallback(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+tries = 1
+fallback_upstream_group = "fallback"
+
+[upstream_group]
+fallback = [%q]
+`, startTestBrokenTransferUpstream(t), startTestTransferUpstream(t)))
+	msg := new(dns.Msg)
+	msg.SetAxfr("example.")
+
+	// The broken transfer must not leave a partial array behind, the whole
+	// answer comes from the fallback upstream.
+	w := httptest.NewRecorder()
+	if err := s.doZoneTransfer(context.Background(), w, &DNSRequest{request: msg}, "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	var responses []jsondns.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("output is not a JSON array: %v\n%s", err, w.Body.Bytes())
+	}
+	if len(responses) != 3 {
+		t.Errorf("got %d responses, want 3: %s", len(responses), w.Body.Bytes())
+	}
+}
+
+func TestZoneTransferJSONFailure(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t, fmt.Sprintf("upstream = [%q]\ntries = 1\n", startTestBrokenTransferUpstream(t)))
+	msg := new(dns.Msg)
+	msg.SetAxfr("example.")
+
+	w := httptest.NewRecorder()
+	if err := s.doZoneTransfer(context.Background(), w, &DNSRequest{request: msg}, "application/json"); err == nil {
+		t.Fatal("doZoneTransfer succeeded with a broken upstream")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("partial JSON output written: %s", w.Body.Bytes())
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Allowed clock skew for TSIG signatures, RFC 8945 Section 10
+const tsigFudge = 300
+
+// tsigKey signs the queries to an upstream.
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+// loadTSIGKeys reads the secrets of the upstreams configured with TSIG. It
+// returns the keys by upstream, and the secrets by key name as used by
+// dns.Client.
+func loadTSIGKeys(conf *config) (map[string]*tsigKey, map[string]string, error) {
+	keys := make(map[string]*tsigKey)
+	secrets := make(map[string]string)
+	if conf.ZoneTransferTSIGKey != "" {
+		secrets[conf.ZoneTransferTSIGKey] = conf.ZoneTransferTSIGSecret
+	}
+	for us, opts := range conf.UpstreamOptions {
+		if opts.TSIGKey == "" {
+			continue
+		}
+		data, err := os.ReadFile(opts.TSIGSecretFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		secret := strings.TrimSpace(string(data))
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil || secret == "" {
+			return nil, nil, fmt.Errorf("TSIG secret file %s must contain a base64-encoded key", opts.TSIGSecretFile)
+		}
+		if other, ok := secrets[opts.TSIGKey]; ok && other != secret {
+			return nil, nil, &configError{fmt.Sprintf("TSIG key %s is configured with different secrets", opts.TSIGKey)}
+		}
+		secrets[opts.TSIGKey] = secret
+		keys[us] = &tsigKey{
+			name:      opts.TSIGKey,
+			algorithm: opts.TSIGAlgorithm,
+			secret:    secret,
+		}
+	}
+	return keys, secrets, nil
+}
+
+// sign adds a TSIG record to the query. The signature itself is computed
+// by dns.Client when the query is sent.
+func (key *tsigKey) sign(query *dns.Msg) {
+	query.SetTsig(key.name, key.algorithm, tsigFudge, time.Now().Unix())
+}
+
+// checkSigned rejects a response to a signed query that came back unsigned.
+// Bad signatures are rejected by dns.Client already. The TSIG record is
+// removed, it is of no use to the client.
+func checkSigned(resp *dns.Msg) error {
+	if resp.IsTsig() == nil {
+		return errors.New("upstream response is not TSIG-signed")
+	}
+	resp.Extra = resp.Extra[:len(resp.Extra)-1]
+	return nil
+}
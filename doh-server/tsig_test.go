@@ -0,0 +1,149 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestTSIGUpstream answers on a UDP port of the loopback interface,
+// signing its responses with secret unless it is empty, and returns its address
+// as written in upstream lists.
+func startTestTSIGUpstream(t *testing.T, secret string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := dns.NewRR("www.example. 300 IN A 192.0.2.1")
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = []dns.RR{a}
+		if secret != "" {
+			resp.SetTsig("doh-server.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		}
+		w.WriteMsg(resp)
+	})}
+	if secret != "" {
+		server.TsigSecret = map[string]string{"doh-server.": secret}
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return "udp:" + pc.LocalAddr().String()
+}
+
+func TestTSIGUpstream(t *testing.T) {
+	t.Parallel()
+
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	otherSecret := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	secretFile := filepath.Join(t.TempDir(), "tsig.secret")
+	if err := os.WriteFile(secretFile, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name         string
+		signedWith   string
+		wantAccepted bool
+	}{
+		{"unsigned", "", false},
+		{"bad signature", otherSecret, false},
+		{"valid signature", secret, true},
+	} {
+		upstream := startTestTSIGUpstream(t, tt.signedWith)
+		s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q]
+tries = 1
+
+[upstream_options.%q]
+tsig_key = "doh-server"
+tsig_secret_file = %q
+`, upstream, upstream, secretFile))
+
+		w := httptest.NewRecorder()
+		s.handlerFunc(w, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil))
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !tt.wantAccepted {
+			if resp.Rcode != dns.RcodeServerFailure || len(resp.Answer) != 0 {
+				t.Errorf("%s: response accepted:\n%v", tt.name, resp)
+			}
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("%s: response rejected:\n%v", tt.name, resp)
+		}
+		if resp.IsTsig() != nil {
+			t.Errorf("%s: TSIG record passed on to the client", tt.name)
+		}
+	}
+}
+
+func TestTSIGHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	secret := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	secretFile := filepath.Join(t.TempDir(), "tsig.secret")
+	if err := os.WriteFile(secretFile, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signed, unsigned := startTestTSIGUpstream(t, secret), startTestTSIGUpstream(t, "")
+	s := newTestServer(t, fmt.Sprintf(`
+upstream = [%q, %q]
+
+[upstream_options.%q]
+tsig_key = "doh-server"
+tsig_secret_file = %q
+
+[upstream_options.%q]
+tsig_key = "doh-server"
+tsig_secret_file = %q
+`, signed, unsigned, signed, secretFile, unsigned, secretFile))
+
+	if _, err := s.checkUpstream(signed); err != nil {
+		t.Errorf("signed upstream failed the check: %v", err)
+	}
+	if _, err := s.checkUpstream(unsigned); err == nil {
+		t.Error("upstream answering unsigned passed the check")
+	}
+}
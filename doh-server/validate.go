@@ -0,0 +1,281 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// validateResponse checks that resp answers query: it must be a response
+// with the same opcode and the same question. If matchCase is set, the query
+// name must come back in the same case, see randomizeCase.
+func validateResponse(query, resp *dns.Msg, matchCase bool) error {
+	if !resp.Response {
+		return errors.New("upstream reply is not a response")
+	}
+	if resp.Opcode != query.Opcode {
+		return fmt.Errorf("upstream reply has opcode %d, want %d", resp.Opcode, query.Opcode)
+	}
+	// Some servers leave out the question of error responses.
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	if len(resp.Question) != len(query.Question) {
+		return fmt.Errorf("upstream reply has %d questions, want %d", len(resp.Question), len(query.Question))
+	}
+	for i, q := range query.Question {
+		r := resp.Question[i]
+		if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !strings.EqualFold(r.Name, q.Name) {
+			return fmt.Errorf("upstream reply is for %s, want %s", r.String(), q.String())
+		}
+		if matchCase && r.Name != q.Name {
+			return errCaseMismatch
+		}
+	}
+	return nil
+}
+
+var errCaseMismatch = errors.New("upstream did not preserve the case of the query name")
+
+// randomizeCase flips the case of the letters in the query name at random
+// (DNS 0x20, draft-vixie-dnsext-dns0x20), adding entropy an off-path attacker
+// has to guess. It returns the original name.
+func randomizeCase(msg *dns.Msg) string {
+	name := msg.Question[0].Name
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.Intn(2) == 0 {
+			b[i] = c ^ 0x20
+		}
+	}
+	msg.Question[0].Name = string(b)
+	return name
+}
+
+// restoreCase puts the client's spelling of the query name back into the
+// response, wherever upstream echoed the randomized one.
+func restoreCase(resp *dns.Msg, name string) {
+	for i := range resp.Question {
+		if strings.EqualFold(resp.Question[i].Name, name) {
+			resp.Question[i].Name = name
+		}
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// dnssecProofs marks the NSEC, NSEC3 and RRSIG records in rrs that may prove
+// something about names: RRSIGs by a zone enclosing one of them, the NSEC and
+// NSEC3 records such an RRSIG covers, and NSEC records covering one of them.
+func dnssecProofs(rrs []dns.RR, names map[string]bool) []bool {
+	enclosesName := func(zone string) bool {
+		for name := range names {
+			if dns.IsSubDomain(zone, name) {
+				return true
+			}
+		}
+		return false
+	}
+	signed := make(map[rrsetKey]bool)
+	proofs := make([]bool, len(rrs))
+	for i, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && enclosesName(dns.CanonicalName(sig.SignerName)) {
+			proofs[i] = true
+			signed[rrsetKey{dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered}] = true
+		}
+	}
+	for i, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			owner := dns.CanonicalName(rr.Hdr.Name)
+			next := dns.CanonicalName(rr.NextDomain)
+			if signed[rrsetKey{owner, dns.TypeNSEC}] {
+				proofs[i] = true
+				continue
+			}
+			for name := range names {
+				if nsecCovers(owner, next, name) {
+					proofs[i] = true
+					break
+				}
+			}
+		case *dns.NSEC3:
+			proofs[i] = signed[rrsetKey{dns.CanonicalName(rr.Hdr.Name), dns.TypeNSEC3}]
+		}
+	}
+	return proofs
+}
+
+// nsecCovers reports whether the NSEC record from owner to next covers or
+// matches name.
+func nsecCovers(owner, next, name string) bool {
+	if compareCanonical(owner, next) < 0 {
+		return compareCanonical(owner, name) <= 0 && compareCanonical(name, next) < 0
+	}
+	// The last NSEC of the zone wraps around to its apex.
+	return dns.IsSubDomain(next, name) && compareCanonical(owner, name) <= 0
+}
+
+// compareCanonical compares two lowercase domain names in canonical DNS
+// order (RFC 4034, section 6.1).
+func compareCanonical(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// scrubResponse removes records that upstream had no business sending
+// along with the answer, and returns how many it removed:
+//   - answer records that are not for the query name or the names its
+//     CNAME and DNAME records lead to
+//   - authority records outside the zone the answer came from, which is the
+//     closest SOA or NS owner in the authority section enclosing a name in
+//     the alias chain, apart from DNSSEC proofs for the chain (a wildcard
+//     answer comes with those alone)
+//   - additional records that are not addresses of names referred to by the
+//     answer or authority, apart from OPT, TSIG and SIG(0)
+func scrubResponse(resp *dns.Msg) int {
+	if len(resp.Question) == 0 {
+		return 0
+	}
+	removed := 0
+
+	// Follow the alias chain in the order upstream gave it, which is
+	// usually but not necessarily the chain order.
+	names := map[string]bool{dns.CanonicalName(resp.Question[0].Name): true}
+	keep := make([]bool, len(resp.Answer))
+	for changed := true; changed; {
+		changed = false
+		for i, rr := range resp.Answer {
+			if keep[i] {
+				continue
+			}
+			owner := dns.CanonicalName(rr.Header().Name)
+			switch rr := rr.(type) {
+			case *dns.DNAME:
+				for name := range names {
+					if dns.IsSubDomain(owner, name) && name != owner {
+						keep[i] = true
+						break
+					}
+				}
+			default:
+				keep[i] = names[owner]
+				if cname, ok := rr.(*dns.CNAME); ok && keep[i] {
+					names[dns.CanonicalName(cname.Target)] = true
+				}
+			}
+			changed = changed || keep[i]
+		}
+	}
+	answer := resp.Answer[:0]
+	for i, rr := range resp.Answer {
+		if keep[i] {
+			answer = append(answer, rr)
+		} else {
+			removed++
+		}
+	}
+	resp.Answer = answer
+
+	// The zone that answered encloses a name in the chain, for a chain that
+	// crosses zones the last one.
+	var zone string
+	for _, rr := range resp.Ns {
+		rrtype := rr.Header().Rrtype
+		if rrtype != dns.TypeSOA && rrtype != dns.TypeNS {
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		var enclosing bool
+		for name := range names {
+			if dns.IsSubDomain(owner, name) {
+				enclosing = true
+				break
+			}
+		}
+		if enclosing && (zone == "" || dns.CountLabel(owner) > dns.CountLabel(zone)) {
+			zone = owner
+		}
+	}
+	proofs := dnssecProofs(resp.Ns, names)
+	targets := make(map[string]bool)
+	ns := resp.Ns[:0]
+	for i, rr := range resp.Ns {
+		if proofs[i] || zone != "" && dns.IsSubDomain(zone, dns.CanonicalName(rr.Header().Name)) {
+			ns = append(ns, rr)
+			if rr, ok := rr.(*dns.NS); ok {
+				targets[dns.CanonicalName(rr.Ns)] = true
+			}
+		} else {
+			removed++
+		}
+	}
+	resp.Ns = ns
+
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			targets[dns.CanonicalName(rr.Ns)] = true
+		case *dns.MX:
+			targets[dns.CanonicalName(rr.Mx)] = true
+		case *dns.SRV:
+			targets[dns.CanonicalName(rr.Target)] = true
+		case *dns.SVCB:
+			targets[dns.CanonicalName(rr.Target)] = true
+		case *dns.HTTPS:
+			targets[dns.CanonicalName(rr.Target)] = true
+		}
+	}
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG, dns.TypeSIG:
+			extra = append(extra, rr)
+			continue
+		case dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG:
+			if targets[dns.CanonicalName(rr.Header().Name)] {
+				extra = append(extra, rr)
+				continue
+			}
+		}
+		removed++
+	}
+	resp.Extra = extra
+	return removed
+}
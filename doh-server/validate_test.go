@@ -0,0 +1,157 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateResponse(t *testing.T) {
+	t.Parallel()
+	query := new(dns.Msg)
+	query.SetQuestion("ExAmPle.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	if err := validateResponse(query, resp, true); err != nil {
+		t.Errorf("matching response rejected: %v", err)
+	}
+
+	resp.Question[0].Name = "example.com."
+	if err := validateResponse(query, resp, false); err != nil {
+		t.Errorf("response in other case rejected: %v", err)
+	}
+	if err := validateResponse(query, resp, true); err != errCaseMismatch {
+		t.Errorf("response in other case: got %v, want errCaseMismatch", err)
+	}
+
+	resp.Question[0].Name = "example.net."
+	if err := validateResponse(query, resp, false); err == nil {
+		t.Error("response for another name accepted")
+	}
+
+	resp.SetReply(query)
+	resp.Response = false
+	if err := validateResponse(query, resp, false); err == nil {
+		t.Error("query accepted as response")
+	}
+}
+
+func TestScrubResponse(t *testing.T) {
+	t.Parallel()
+	resp := new(dns.Msg)
+	resp.SetQuestion("www.example.com.", dns.TypeA)
+	for _, section := range []struct {
+		rrs *[]dns.RR
+		rr  []string
+	}{
+		{&resp.Answer, []string{
+			"www.example.com. 300 IN CNAME cdn.example.net.",
+			"cdn.example.net. 300 IN A 192.0.2.1",
+			"bank.example.org. 300 IN A 203.0.113.66",
+		}},
+		{&resp.Ns, []string{
+			"example.net. 300 IN NS ns1.example.net.",
+			"example.org. 300 IN NS ns.attacker.example.",
+		}},
+		{&resp.Extra, []string{
+			"ns1.example.net. 300 IN A 192.0.2.53",
+			"ns.attacker.example. 300 IN A 203.0.113.53",
+		}},
+	} {
+		for _, s := range section.rr {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+
+	if removed := scrubResponse(resp); removed != 3 {
+		t.Errorf("removed %d records, want 3", removed)
+	}
+	if len(resp.Answer) != 2 || len(resp.Ns) != 1 || len(resp.Extra) != 1 {
+		t.Errorf("unexpected records left:\n%v", resp)
+	}
+}
+
+func TestScrubResponseWildcardProof(t *testing.T) {
+	t.Parallel()
+	resp := new(dns.Msg)
+	resp.SetQuestion("www.example.com.", dns.TypeA)
+	for _, section := range []struct {
+		rrs *[]dns.RR
+		rr  []string
+	}{
+		{&resp.Answer, []string{
+			"www.example.com. 300 IN A 192.0.2.1",
+			"www.example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA",
+		}},
+		{&resp.Ns, []string{
+			"mail.example.com. 300 IN NSEC zz.example.com. A RRSIG NSEC",
+			"mail.example.com. 300 IN RRSIG NSEC 13 3 300 20300101000000 20200101000000 12345 example.com. AAAA",
+			"bank.example.org. 300 IN NSEC zz.example.org. A RRSIG NSEC",
+			"bank.example.org. 300 IN RRSIG NSEC 13 3 300 20300101000000 20200101000000 12345 example.org. AAAA",
+		}},
+	} {
+		for _, s := range section.rr {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+
+	if removed := scrubResponse(resp); removed != 2 {
+		t.Errorf("removed %d records, want 2", removed)
+	}
+	if len(resp.Answer) != 2 || len(resp.Ns) != 2 || resp.Ns[0].Header().Name != "mail.example.com." {
+		t.Errorf("unexpected records left:\n%v", resp)
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		owner, next, name string
+		want              bool
+	}{
+		{"a.example.", "c.example.", "b.example.", true},
+		{"a.example.", "c.example.", "a.example.", true},
+		{"a.example.", "c.example.", "c.example.", false},
+		{"a.example.", "c.example.", "x.b.example.", true},
+		{"a.example.", "c.example.", "example.", false},
+		{"z.example.", "example.", "zz.example.", true},
+		{"z.example.", "example.", "b.example.", false},
+		{"z.example.", "example.", "com.", false},
+	} {
+		if got := nsecCovers(tc.owner, tc.next, tc.name); got != tc.want {
+			t.Errorf("nsecCovers(%q, %q, %q) = %v", tc.owner, tc.next, tc.name, got)
+		}
+	}
+}
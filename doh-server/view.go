@@ -0,0 +1,123 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/infobloxopen/go-trees/iptree"
+	"github.com/miekg/dns"
+)
+
+// view is a split-horizon view: clients selected by address or certificate
+// identity get their own upstreams, local zones and blocklist.
+type view struct {
+	name       string
+	conf       *viewConfig
+	clients    *iptree.Tree
+	localZones *localZones
+	blocklist  *blocklist
+}
+
+type viewContextKey struct{}
+
+func newView(conf *viewConfig) (*view, error) {
+	v := &view{
+		name:    conf.Name,
+		conf:    conf,
+		clients: newNetworkTree(conf.Clients),
+	}
+	if len(conf.LocalZones) != 0 {
+		lz, err := newLocalZones(conf.LocalZones)
+		if err != nil {
+			return nil, err
+		}
+		v.localZones = lz
+	}
+	if conf.Blocklist != "" {
+		bl, err := newBlocklist(conf.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+		v.blocklist = bl
+	}
+	return v, nil
+}
+
+// matches reports whether the client belongs to the view. A view without
+// clients or identities matches everyone.
+func (v *view) matches(r *http.Request) bool {
+	if v.clients == nil && len(v.conf.Identities) == 0 {
+		return true
+	}
+	if v.clients != nil {
+		if ip := clientAddr(r); ip != nil {
+			if _, ok := v.clients.GetByIP(ip); ok {
+				return true
+			}
+		}
+	}
+	if id := clientIdentityFromRequest(r); id != nil {
+		for _, pattern := range v.conf.Identities {
+			if id.matches(pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectView returns the first view the client belongs to, or nil.
+func (s *Server) selectView(r *http.Request) *view {
+	for _, v := range s.views {
+		if v.matches(r) {
+			return v
+		}
+	}
+	return nil
+}
+
+// answer returns a response from the view's local zones or blocklist, or nil
+// if the query is to be sent upstream.
+func (v *view) answer(msg *dns.Msg) *dns.Msg {
+	if v == nil || len(msg.Question) == 0 {
+		return nil
+	}
+	if reply := v.localZones.answer(msg); reply != nil {
+		return reply
+	}
+	if v.blocklist != nil && v.blocklist.contains(msg.Question[0].Name) {
+		reply := new(dns.Msg)
+		reply.SetRcode(msg, dns.RcodeNameError)
+		reply.RecursionAvailable = true
+		return reply
+	}
+	return nil
+}
+
+func viewFromContext(ctx context.Context) *view {
+	v, _ := ctx.Value(viewContextKey{}).(*view)
+	return v
+}
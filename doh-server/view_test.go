@@ -0,0 +1,118 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveThroughListener passes a request with a spoofable X-Real-IP header from
+// peer through l, and calls f with the request as the handlers see it.
+func serveThroughListener(l *listener, peer string, f func(r *http.Request)) {
+	r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+	r.RemoteAddr = peer
+	r.Header.Set("X-Real-IP", "10.1.2.3")
+	l.serveHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like handlerFunc, which rewrites it for logging
+		r.RemoteAddr = r.Header.Get("X-Real-IP") + ":0"
+		f(r)
+	}), httptest.NewRecorder(), r)
+}
+
+func newTestListener() *listener {
+	return &listener{
+		paths:          map[string]struct{}{"/dns-query": {}},
+		trustedProxies: newNetworkTree([]string{"127.0.0.0/8", "::1/128"}),
+	}
+}
+
+func TestSelectViewRealIP(t *testing.T) {
+	t.Parallel()
+
+	office, err := newView(&viewConfig{Name: "office", Clients: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{views: []*view{office}}
+	l := newTestListener()
+
+	serveThroughListener(l, "198.51.100.7:1234", func(r *http.Request) {
+		if v := s.selectView(r); v != nil {
+			t.Errorf("untrusted peer got view %q with a spoofed X-Real-IP", v.name)
+		}
+	})
+	serveThroughListener(l, "127.0.0.1:1234", func(r *http.Request) {
+		if v := s.selectView(r); v != office {
+			t.Errorf("X-Real-IP from a trusted proxy ignored: %v", v)
+		}
+	})
+}
+
+func TestSelectView(t *testing.T) {
+	t.Parallel()
+
+	office, err := newView(&viewConfig{Name: "office", Clients: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptops, err := newView(&viewConfig{Name: "laptops", Identities: []string{"*.corp.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := newView(&viewConfig{Name: "public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{views: []*view{office, laptops, public}}
+
+	request := func(peer, identity string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+		r.RemoteAddr = peer
+		if identity != "" {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: identity}},
+			}}}
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		peer, identity string
+		want           *view
+	}{
+		{"10.1.2.3:1234", "", office},
+		{"10.1.2.3:1234", "laptop.corp.example.com", office},
+		{"198.51.100.7:1234", "laptop.corp.example.com", laptops},
+		{"198.51.100.7:1234", "laptop.example.com", public},
+		{"198.51.100.7:1234", "", public},
+	} {
+		if v := s.selectView(request(tt.peer, tt.identity)); v != tt.want {
+			t.Errorf("peer %s, identity %q: got view %v, want %q", tt.peer, tt.identity, v, tt.want.name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+   DNS-over-HTTPS
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// How often a watched file is checked for modification at most.
+const fileCheckInterval = 10 * time.Second
+
+// watchedFile remembers the modification time and size of a file, so that
+// whoever loaded it can tell when it has been replaced on disk.
+type watchedFile struct {
+	path      string
+	mu        sync.Mutex
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func newWatchedFile(path string) *watchedFile {
+	f := &watchedFile{
+		path:      path,
+		lastCheck: time.Now(),
+	}
+	if fi, err := os.Stat(path); err == nil {
+		f.modTime, f.size = fi.ModTime(), fi.Size()
+	}
+	return f
+}
+
+// changed reports whether the file has been modified since the last call
+// that returned true, or since it was created. A nil watchedFile never
+// changes.
+func (f *watchedFile) changed() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.lastCheck) < fileCheckInterval {
+		return false
+	}
+	f.lastCheck = now
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return false
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return true
+}
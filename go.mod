@@ -7,6 +7,8 @@ require (
 	github.com/gorilla/handlers v1.5.2
 	github.com/infobloxopen/go-trees v0.0.0-20221216143356-66ceba885ebc
 	github.com/miekg/dns v1.1.68
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/crypto v0.44.0
 	golang.org/x/net v0.47.0
 )
 
@@ -0,0 +1,49 @@
+package selector
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// splitDNSURL splits a DNS upstream like udp:1.1.1.1:53 into the network and
+// the address.
+func splitDNSURL(url string) (network, address string, err error) {
+	network, address, ok := strings.Cut(url, ":")
+	if !ok || address == "" {
+		return "", "", errors.New("DNS upstream has not a (udp|tcp|tcp-tls) prefix e.g. udp:1.1.1.1:53")
+	}
+
+	switch network {
+	case "udp", "tcp", "tcp-tls":
+		return network, address, nil
+
+	default:
+		return "", "", errors.New("invalid DNS upstream prefix, choose one of: udp tcp tcp-tls")
+	}
+}
+
+// checkDNS queries www.example.com from a DNS upstream and returns the round
+// trip time. Any response counts, an upstream that answers is alive.
+func checkDNS(url string, timeout time.Duration) (time.Duration, error) {
+	network, address, err := splitDNSURL(url)
+	if err != nil {
+		return 0, err
+	}
+
+	client := dns.Client{Net: network, Timeout: timeout}
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	_, rtt, err := client.Exchange(msg, address)
+
+	return rtt, err
+}
+
+// plainDNSCheck is the DNS check of a selector until SetDNSCheck is called.
+func plainDNSCheck(timeout time.Duration) DNSCheckFunc {
+	return func(url string) (time.Duration, error) {
+		return checkDNS(url, timeout)
+	}
+}
@@ -0,0 +1,156 @@
+package selector
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LowestLatencySelector picks the upstream with the lowest smoothed round trip
+// time. Upstreams not measured yet are picked first.
+type LowestLatencySelector struct {
+	upstreams []*Upstream  // upstreamsInfo
+	client    http.Client  // http client to check the upstream
+	dnsCheck  DNSCheckFunc // checks a DNS upstream
+}
+
+func NewLowestLatencySelector(timeout time.Duration) *LowestLatencySelector {
+	return &LowestLatencySelector{
+		client:   http.Client{Timeout: timeout},
+		dnsCheck: plainDNSCheck(timeout),
+	}
+}
+
+func (ls *LowestLatencySelector) SetDNSCheck(check DNSCheckFunc) {
+	ls.dnsCheck = check
+}
+
+func (ls *LowestLatencySelector) Add(url string, upstreamType UpstreamType) (err error) {
+	u, err := newUpstream(url, upstreamType, 0)
+	if err != nil {
+		return err
+	}
+	ls.upstreams = append(ls.upstreams, u)
+
+	return nil
+}
+
+// StartEvaluate measures every upstream periodically, so that upstreams
+// penalized for failures get another chance once they recover.
+func (ls *LowestLatencySelector) StartEvaluate() {
+	go func() {
+		for {
+			wg := sync.WaitGroup{}
+
+			for i := range ls.upstreams {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					upstream := ls.upstreams[i]
+					rtt, err := ls.check(upstream)
+					if err != nil {
+						atomic.StoreInt64(&upstream.latency, int64(ls.client.Timeout))
+						return
+					}
+					// A fresh measurement replaces the penalty.
+					atomic.StoreInt64(&upstream.latency, int64(rtt))
+				}(i)
+			}
+
+			wg.Wait()
+
+			time.Sleep(15 * time.Second)
+		}
+	}()
+}
+
+func (ls *LowestLatencySelector) check(upstream *Upstream) (time.Duration, error) {
+	if upstream.Type == DNS {
+		return ls.dnsCheck(upstream.URL)
+	}
+
+	upstreamURL := upstream.URL
+	var acceptType string
+
+	switch upstream.Type {
+	case Google:
+		upstreamURL += "?name=www.example.com&type=A"
+		acceptType = "application/dns-json"
+
+	case IETF:
+		// www.example.com
+		upstreamURL += "?dns=q80BAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
+		acceptType = "application/dns-message"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, upstreamURL, http.NoBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("accept", acceptType)
+
+	start := time.Now()
+	resp, err := ls.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return time.Since(start), nil
+}
+
+func (ls *LowestLatencySelector) Get() *Upstream {
+	best := ls.upstreams[0]
+	bestLatency := atomic.LoadInt64(&best.latency)
+
+	for _, upstream := range ls.upstreams[1:] {
+		if latency := atomic.LoadInt64(&upstream.latency); latency < bestLatency {
+			best, bestLatency = upstream, latency
+		}
+	}
+
+	return best
+}
+
+func (ls *LowestLatencySelector) ReportUpstreamStatus(upstream *Upstream, upstreamStatus upstreamStatus) {
+	switch upstreamStatus {
+	case Timeout:
+		atomic.StoreInt64(&upstream.latency, int64(ls.client.Timeout))
+
+	case Error:
+		// Double the latency, up to the timeout penalty.
+		latency := 2 * atomic.LoadInt64(&upstream.latency)
+		if latency == 0 || latency > int64(ls.client.Timeout) {
+			latency = int64(ls.client.Timeout)
+		}
+		atomic.StoreInt64(&upstream.latency, latency)
+	}
+}
+
+// ReportUpstreamLatency keeps an exponentially weighted moving average of the
+// round trip time, weighting the new sample by 1/4.
+func (ls *LowestLatencySelector) ReportUpstreamLatency(upstream *Upstream, rtt time.Duration) {
+	latency := atomic.LoadInt64(&upstream.latency)
+	if latency == 0 {
+		latency = int64(rtt)
+	} else {
+		latency += (int64(rtt) - latency) / 4
+	}
+	atomic.StoreInt64(&upstream.latency, latency)
+}
+
+func (ls *LowestLatencySelector) ReportWeights() {
+	go func() {
+		for {
+			time.Sleep(15 * time.Second)
+
+			for _, u := range ls.upstreams {
+				log.Printf("%s, latency: %s", u, time.Duration(atomic.LoadInt64(&u.latency)))
+			}
+		}
+	}()
+}
@@ -11,8 +11,9 @@ import (
 )
 
 type LVSWRRSelector struct {
-	upstreams     []*Upstream // upstreamsInfo
-	client        http.Client // http client to check the upstream
+	upstreams     []*Upstream  // upstreamsInfo
+	client        http.Client  // http client to check the upstream
+	dnsCheck      DNSCheckFunc // checks a DNS upstream
 	lastChoose    int32
 	currentWeight int32
 }
@@ -20,37 +21,25 @@ type LVSWRRSelector struct {
 func NewLVSWRRSelector(timeout time.Duration) *LVSWRRSelector {
 	return &LVSWRRSelector{
 		client:     http.Client{Timeout: timeout},
+		dnsCheck:   plainDNSCheck(timeout),
 		lastChoose: -1,
 	}
 }
 
+func (ls *LVSWRRSelector) SetDNSCheck(check DNSCheckFunc) {
+	ls.dnsCheck = check
+}
+
 func (ls *LVSWRRSelector) Add(url string, upstreamType UpstreamType, weight int32) (err error) {
 	if weight < 1 {
 		return errors.New("weight is 1")
 	}
 
-	switch upstreamType {
-	case Google:
-		ls.upstreams = append(ls.upstreams, &Upstream{
-			Type:            Google,
-			URL:             url,
-			RequestType:     "application/dns-json",
-			weight:          weight,
-			effectiveWeight: weight,
-		})
-
-	case IETF:
-		ls.upstreams = append(ls.upstreams, &Upstream{
-			Type:            IETF,
-			URL:             url,
-			RequestType:     "application/dns-message",
-			weight:          weight,
-			effectiveWeight: weight,
-		})
-
-	default:
-		return errors.New("unknown upstream type")
+	u, err := newUpstream(url, upstreamType, weight)
+	if err != nil {
+		return err
 	}
+	ls.upstreams = append(ls.upstreams, u)
 
 	return nil
 }
@@ -66,6 +55,11 @@ func (ls *LVSWRRSelector) StartEvaluate() {
 				go func(i int) {
 					defer wg.Done()
 
+					if ls.upstreams[i].Type == DNS {
+						ls.checkDNSUpstream(ls.upstreams[i])
+						return
+					}
+
 					upstreamURL := ls.upstreams[i].URL
 					var acceptType string
 
@@ -249,6 +243,19 @@ func (ls *LVSWRRSelector) checkIETFResponse(resp *http.Response, upstream *Upstr
 	}
 }
 
+func (ls *LVSWRRSelector) checkDNSUpstream(upstream *Upstream) {
+	if _, err := ls.dnsCheck(upstream.URL); err != nil {
+		if atomic.AddInt32(&upstream.effectiveWeight, -5) < 1 {
+			atomic.StoreInt32(&upstream.effectiveWeight, 1)
+		}
+		return
+	}
+
+	if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
+		atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
+	}
+}
+
 func (ls *LVSWRRSelector) ReportWeights() {
 	go func() {
 		for {
@@ -2,7 +2,6 @@ package selector
 
 import (
 	"encoding/json"
-	"errors"
 	"log"
 	"net/http"
 	"sync"
@@ -11,39 +10,28 @@ import (
 )
 
 type NginxWRRSelector struct {
-	upstreams []*Upstream // upstreamsInfo
-	client    http.Client // http client to check the upstream
+	upstreams []*Upstream  // upstreamsInfo
+	client    http.Client  // http client to check the upstream
+	dnsCheck  DNSCheckFunc // checks a DNS upstream
 }
 
 func NewNginxWRRSelector(timeout time.Duration) *NginxWRRSelector {
 	return &NginxWRRSelector{
-		client: http.Client{Timeout: timeout},
+		client:   http.Client{Timeout: timeout},
+		dnsCheck: plainDNSCheck(timeout),
 	}
 }
 
+func (ws *NginxWRRSelector) SetDNSCheck(check DNSCheckFunc) {
+	ws.dnsCheck = check
+}
+
 func (ws *NginxWRRSelector) Add(url string, upstreamType UpstreamType, weight int32) (err error) {
-	switch upstreamType {
-	case Google:
-		ws.upstreams = append(ws.upstreams, &Upstream{
-			Type:            Google,
-			URL:             url,
-			RequestType:     "application/dns-json",
-			weight:          weight,
-			effectiveWeight: weight,
-		})
-
-	case IETF:
-		ws.upstreams = append(ws.upstreams, &Upstream{
-			Type:            IETF,
-			URL:             url,
-			RequestType:     "application/dns-message",
-			weight:          weight,
-			effectiveWeight: weight,
-		})
-
-	default:
-		return errors.New("unknown upstream type")
+	u, err := newUpstream(url, upstreamType, weight)
+	if err != nil {
+		return err
 	}
+	ws.upstreams = append(ws.upstreams, u)
 
 	return nil
 }
@@ -59,6 +47,11 @@ func (ws *NginxWRRSelector) StartEvaluate() {
 				go func(i int) {
 					defer wg.Done()
 
+					if ws.upstreams[i].Type == DNS {
+						ws.checkDNSUpstream(ws.upstreams[i])
+						return
+					}
+
 					upstreamURL := ws.upstreams[i].URL
 					var acceptType string
 
@@ -202,6 +195,19 @@ func (ws *NginxWRRSelector) checkIETFResponse(resp *http.Response, upstream *Ups
 	}
 }
 
+func (ws *NginxWRRSelector) checkDNSUpstream(upstream *Upstream) {
+	if _, err := ws.dnsCheck(upstream.URL); err != nil {
+		if atomic.AddInt32(&upstream.effectiveWeight, -10) < 1 {
+			atomic.StoreInt32(&upstream.effectiveWeight, 1)
+		}
+		return
+	}
+
+	if atomic.AddInt32(&upstream.effectiveWeight, 5) > upstream.weight {
+		atomic.StoreInt32(&upstream.effectiveWeight, upstream.weight)
+	}
+}
+
 func (ws *NginxWRRSelector) ReportWeights() {
 	go func() {
 		for {
@@ -1,7 +1,6 @@
 package selector
 
 import (
-	"errors"
 	"math/rand"
 	"time"
 )
@@ -19,24 +18,11 @@ func NewRandomSelector() *RandomSelector {
 }
 
 func (rs *RandomSelector) Add(url string, upstreamType UpstreamType) (err error) {
-	switch upstreamType {
-	case Google:
-		rs.upstreams = append(rs.upstreams, &Upstream{
-			Type:        Google,
-			URL:         url,
-			RequestType: "application/dns-json",
-		})
-
-	case IETF:
-		rs.upstreams = append(rs.upstreams, &Upstream{
-			Type:        IETF,
-			URL:         url,
-			RequestType: "application/dns-message",
-		})
-
-	default:
-		return errors.New("unknown upstream type")
+	u, err := newUpstream(url, upstreamType, 0)
+	if err != nil {
+		return err
 	}
+	rs.upstreams = append(rs.upstreams, u)
 
 	return nil
 }
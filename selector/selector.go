@@ -0,0 +1,33 @@
+package selector
+
+import "time"
+
+type Selector interface {
+	// Get returns a upstream
+	Get() *Upstream
+
+	// StartEvaluate start upstream evaluation loop
+	StartEvaluate()
+
+	// ReportUpstreamStatus report upstream status
+	ReportUpstreamStatus(upstream *Upstream, upstreamStatus upstreamStatus)
+}
+
+type DebugReporter interface {
+	// ReportWeights starts a goroutine to report all upstream weights, recommend interval is 15s
+	ReportWeights()
+}
+
+type LatencyReporter interface {
+	// ReportUpstreamLatency report the round trip time of a successful query
+	ReportUpstreamLatency(upstream *Upstream, rtt time.Duration)
+}
+
+// DNSCheckFunc checks a DNS upstream and returns the round trip time.
+type DNSCheckFunc func(url string) (time.Duration, error)
+
+type DNSChecker interface {
+	// SetDNSCheck replaces the plain query checking DNS upstreams, e.g. with
+	// one sent the same way as real queries
+	SetDNSCheck(check DNSCheckFunc)
+}
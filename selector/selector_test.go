@@ -0,0 +1,199 @@
+package selector
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDNSServer answers every query on a UDP port of the loopback interface
+// and returns its address as a DNS upstream URL.
+func startDNSServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return "udp:" + pc.LocalAddr().String()
+}
+
+// deadDNSURL returns a DNS upstream URL nothing listens on.
+func deadDNSURL(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return "udp:" + addr
+}
+
+func TestLowestLatencyGet(t *testing.T) {
+	t.Parallel()
+
+	ls := NewLowestLatencySelector(time.Second)
+	for _, url := range []string{"udp:192.0.2.1:53", "udp:192.0.2.2:53", "udp:192.0.2.3:53"} {
+		if err := ls.Add(url, DNS); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ls.upstreams[0].latency = int64(30 * time.Millisecond)
+	ls.upstreams[1].latency = int64(10 * time.Millisecond)
+	ls.upstreams[2].latency = int64(20 * time.Millisecond)
+	if u := ls.Get(); u != ls.upstreams[1] {
+		t.Errorf("picked %s, want the lowest latency", u.URL)
+	}
+
+	ls.upstreams[2].latency = 0
+	if u := ls.Get(); u != ls.upstreams[2] {
+		t.Errorf("picked %s, want the one not measured yet", u.URL)
+	}
+}
+
+func TestLowestLatencyReport(t *testing.T) {
+	t.Parallel()
+
+	ls := NewLowestLatencySelector(time.Second)
+	if err := ls.Add("udp:192.0.2.1:53", DNS); err != nil {
+		t.Fatal(err)
+	}
+	u := ls.upstreams[0]
+
+	ls.ReportUpstreamLatency(u, 100*time.Millisecond)
+	if u.latency != int64(100*time.Millisecond) {
+		t.Errorf("first sample: latency %s", time.Duration(u.latency))
+	}
+	ls.ReportUpstreamLatency(u, 20*time.Millisecond)
+	if u.latency != int64(80*time.Millisecond) {
+		t.Errorf("second sample: latency %s, want 80ms", time.Duration(u.latency))
+	}
+
+	ls.ReportUpstreamStatus(u, Error)
+	if u.latency != int64(160*time.Millisecond) {
+		t.Errorf("error: latency %s, want 160ms", time.Duration(u.latency))
+	}
+	u.latency = int64(800 * time.Millisecond)
+	ls.ReportUpstreamStatus(u, Error)
+	if u.latency != int64(time.Second) {
+		t.Errorf("error: latency %s, want the timeout", time.Duration(u.latency))
+	}
+	u.latency = 0
+	ls.ReportUpstreamStatus(u, Error)
+	if u.latency != int64(time.Second) {
+		t.Errorf("error before any sample: latency %s, want the timeout", time.Duration(u.latency))
+	}
+
+	u.latency = int64(10 * time.Millisecond)
+	ls.ReportUpstreamStatus(u, Timeout)
+	if u.latency != int64(time.Second) {
+		t.Errorf("timeout: latency %s, want the timeout", time.Duration(u.latency))
+	}
+	ls.ReportUpstreamStatus(u, OK)
+	if u.latency != int64(time.Second) {
+		t.Errorf("OK changed the latency to %s", time.Duration(u.latency))
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	t.Parallel()
+
+	if _, err := checkDNS(startDNSServer(t), time.Second); err != nil {
+		t.Errorf("live upstream: %v", err)
+	}
+	if _, err := checkDNS(deadDNSURL(t), 200*time.Millisecond); err == nil {
+		t.Error("dead upstream passed the check")
+	}
+	if _, err := checkDNS("1.1.1.1:53", time.Second); err == nil {
+		t.Error("upstream without a network prefix passed the check")
+	}
+}
+
+func TestDNSHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	nginx := NewNginxWRRSelector(200 * time.Millisecond)
+	lvs := NewLVSWRRSelector(200 * time.Millisecond)
+	dead, live := deadDNSURL(t), startDNSServer(t)
+	for _, url := range []string{dead, live} {
+		if err := nginx.Add(url, DNS, 20); err != nil {
+			t.Fatal(err)
+		}
+		if err := lvs.Add(url, DNS, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		name      string
+		upstreams []*Upstream
+		check     func(u *Upstream)
+	}{
+		{"nginx", nginx.upstreams, nginx.checkDNSUpstream},
+		{"lvs", lvs.upstreams, lvs.checkDNSUpstream},
+	} {
+		deadUpstream, liveUpstream := tt.upstreams[0], tt.upstreams[1]
+		liveUpstream.effectiveWeight = 1
+		for range 5 {
+			tt.check(deadUpstream)
+			tt.check(liveUpstream)
+		}
+		if deadUpstream.effectiveWeight != 1 {
+			t.Errorf("%s: dead upstream has weight %d, want 1", tt.name, deadUpstream.effectiveWeight)
+		}
+		if liveUpstream.effectiveWeight != 20 {
+			t.Errorf("%s: live upstream has weight %d, want 20", tt.name, liveUpstream.effectiveWeight)
+		}
+	}
+}
+
+func TestSetDNSCheck(t *testing.T) {
+	t.Parallel()
+
+	live := startDNSServer(t)
+	errRejected := errors.New("rejected")
+	var checked []string
+	check := func(url string) (time.Duration, error) {
+		checked = append(checked, url)
+		return 0, errRejected
+	}
+
+	ll := NewLowestLatencySelector(time.Second)
+	nginx := NewNginxWRRSelector(time.Second)
+	lvs := NewLVSWRRSelector(time.Second)
+	if err := ll.Add(live, DNS); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []interface {
+		Add(url string, upstreamType UpstreamType, weight int32) error
+	}{nginx, lvs} {
+		if err := s.Add(live, DNS, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []DNSChecker{ll, nginx, lvs} {
+		s.SetDNSCheck(check)
+	}
+
+	if _, err := ll.check(ll.upstreams[0]); err != errRejected {
+		t.Errorf("lowest_latency: check returned %v", err)
+	}
+	nginx.checkDNSUpstream(nginx.upstreams[0])
+	if w := nginx.upstreams[0].effectiveWeight; w != 10 {
+		t.Errorf("nginx: weight %d after a failed check, want 10", w)
+	}
+	lvs.checkDNSUpstream(lvs.upstreams[0])
+	if w := lvs.upstreams[0].effectiveWeight; w != 15 {
+		t.Errorf("lvs: weight %d after a failed check, want 15", w)
+	}
+	if len(checked) != 3 {
+		t.Errorf("custom check called %d times, want 3", len(checked))
+	}
+}
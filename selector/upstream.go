@@ -0,0 +1,63 @@
+package selector
+
+import (
+	"errors"
+	"fmt"
+)
+
+type UpstreamType int
+
+const (
+	Google UpstreamType = iota
+	IETF
+	// DNS is a plain DNS server, its URL is written like udp:1.1.1.1:53,
+	// tcp:1.1.1.1:53 or tcp-tls:1.1.1.1:853
+	DNS
+)
+
+var typeMap = map[UpstreamType]string{
+	Google: "Google",
+	IETF:   "IETF",
+	DNS:    "DNS",
+}
+
+type Upstream struct {
+	Type            UpstreamType
+	URL             string
+	RequestType     string
+	weight          int32
+	effectiveWeight int32
+	currentWeight   int32
+	latency         int64 // smoothed round trip time in nanoseconds
+}
+
+func newUpstream(url string, upstreamType UpstreamType, weight int32) (*Upstream, error) {
+	u := &Upstream{
+		Type:            upstreamType,
+		URL:             url,
+		weight:          weight,
+		effectiveWeight: weight,
+	}
+
+	switch upstreamType {
+	case Google:
+		u.RequestType = "application/dns-json"
+
+	case IETF:
+		u.RequestType = "application/dns-message"
+
+	case DNS:
+		if _, _, err := splitDNSURL(url); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, errors.New("unknown upstream type")
+	}
+
+	return u, nil
+}
+
+func (u Upstream) String() string {
+	return fmt.Sprintf("upstream type: %s, upstream url: %s", typeMap[u.Type], u.URL)
+}